@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Account is one trading account of the process: the exchange with its keys, the engine with its own state file,
+// the strategies and the telegram channel. All accounts run under the common scheduler
+type Account struct {
+	Name       string
+	Exchange   string
+	Api        ApiInterface
+	Bot        *TgBot
+	Engine     *Engine
+	Strategies []Strategy
+}
+
+var accounts []*Account
+
+// loadAccounts reads the list "accounts=main,second", settings of a named account have its prefix: "main.exmo.key".
+// Without the list the process runs one account with the settings as they are
+func loadAccounts() []*Account {
+	names := []string{""}
+	if list := os.Getenv("accounts"); list != "" {
+		names = strings.Split(list, ",")
+	}
+
+	var result []*Account
+	for _, name := range names {
+		result = append(result, newAccount(strings.TrimSpace(name)))
+	}
+	return result
+}
+
+func newAccount(name string) *Account {
+	account := &Account{Name: name}
+	account.Exchange = account.env("exchange")
+
+	switch account.Exchange {
+	case "exmo":
+		account.Api = new(Exmo).init(account)
+	case "paper":
+		account.Api = new(Exmo).initPaper(account)
+	case "binance":
+		account.Api = new(Binance).init(account)
+	default:
+		log.Fatalf("NO HANDLER for account %s", account)
+	}
+
+	account.Api.showBalance()
+	account.Bot = newTgBot(account)
+	account.Engine = newEngine(
+		account.Api, account.Bot, account.candlesExchange(),
+		s2f(account.env("available.deposit")), parseFees(account.setting("fees")),
+	)
+	account.Strategies = account.getStrategies()
+
+	return account
+}
+
+// env is the own setting of the account: exchange, keys, deposit, strategies
+func (account *Account) env(key string) string {
+	if account.Name == "" {
+		return os.Getenv(key)
+	}
+	return os.Getenv(account.Name + "." + key)
+}
+
+// setting may be common for all accounts: urls, fees, telegram token and channel
+func (account *Account) setting(key string) string {
+	if value := account.env(key); value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// candlesExchange is the source of candles, paper trading uses the exmo ones
+func (account *Account) candlesExchange() string {
+	if account.Exchange == "paper" {
+		return "exmo"
+	}
+	return account.Exchange
+}
+
+// getStrategies parses "params={ETC_USDT long ...}{BTC_USDT short ...}"
+func (account *Account) getStrategies() []Strategy {
+	envParams := account.env("params")
+	if envParams == "" {
+		return nil
+	}
+	params := strings.Split(envParams, "}{")
+	params[0] = params[0][1:]
+	params[len(params)-1] = params[len(params)-1][:len(params[len(params)-1])-1]
+
+	var strategies []Strategy
+	for _, param := range params {
+		strategy := getStrategy(param)
+		strategy.Exchange = account.candlesExchange()
+		strategies = append(strategies, strategy)
+	}
+	return strategies
+}
+
+// run downloads the history of the strategies and schedules the engine
+func (account *Account) run() {
+	if len(account.Strategies) == 0 {
+		return
+	}
+	account.Api.downloadHistoryCandlesForStrategies(getUniqueStrategies(account.Strategies))
+	account.Engine.listen(account.Strategies)
+}
+
+func (account *Account) String() string {
+	if account.Name == "" {
+		return account.Exchange
+	}
+	return account.Name + "/" + account.Exchange
+}
+
+// accountFileName keeps the state files of the accounts apart, the single account keeps the old names
+func accountFileName(account, fileName string) string {
+	if account == "" {
+		return fileName
+	}
+	return account + "_" + fileName
+}
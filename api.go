@@ -1,8 +1,144 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
 type ApiInterface interface {
 	showBalance()
+	getFileName() string
 	downloadHistoryCandlesForStrategies(strategies []Strategy)
 	downloadPairCandles(candleData *CandleData)
-	listenCandles(strategies []Strategy)
+	downloadNewCandleForStrategies(strategies []Strategy)
+	downloadNewCandle(index int64, pair string, resolution Resolution) Candle
+	listenPrices(strategies []Strategy, onTick func(pair string, price, quantity float64, t time.Time, isTrade bool))
+
+	// OrderApi is the spot wallet
+	OrderApi
+	getPairInfo(pair string) (PairInfo, error)
+	getBestBid(pair string) (float64, error)
+	marketBuyTotal(pair string, money, price float64) (int64, error)
+	// margin is the wallet of the short positions
+	margin() OrderApi
+	// foundOrders are the orders sent before a restart and found on the exchange, they are returned once
+	foundOrders() []ClientOrder
+	String() string
+}
+
+// OrderApi places and checks the orders of one wallet of the account
+type OrderApi interface {
+	getBalances() (Balances, error)
+	placeMarketOrder(pair, side string, quantity, price float64) (int64, error)
+	placeLimitOrder(pair, side string, quantity, price float64) (int64, error)
+	cancelOrder(pair string, orderId int64) error
+	getOrderStatus(pair string, orderId int64) (OrderStatus, error)
+	placeStop(pair, side string, quantity, triggerPrice float64) (int64, error)
+	cancelStop(pair string, stopId int64) error
+	getStopOrders(pair string) ([]StopOrder, error)
+	// getTrades returns the latest trades first
+	getTrades(pair string, limit int) ([]Trade, error)
+}
+
+// OcoApi is a wallet that rests the take profit and the stop loss on the same coins at once. A fill of one
+// cancels the other: binance does it for its order lists, the engine does it for the others
+type OcoApi interface {
+	placeOco(pair, side string, quantity, takeProfitPrice, stopLossPrice float64) (takeProfitId, stopLossId int64, err error)
+}
+
+// ErrOrderNotFound is matched by errors.Is for orders that were already filled or cancelled
+var ErrOrderNotFound = errors.New("order not found")
+
+var ErrMarginNotSupported = errors.New("margin trading is not supported")
+
+// NoMargin is the margin wallet of the exchanges without margin trading
+type NoMargin struct{}
+
+func (NoMargin) getBalances() (Balances, error) {
+	return nil, ErrMarginNotSupported
+}
+
+func (NoMargin) placeMarketOrder(pair, side string, quantity, price float64) (int64, error) {
+	return 0, ErrMarginNotSupported
+}
+
+func (NoMargin) placeLimitOrder(pair, side string, quantity, price float64) (int64, error) {
+	return 0, ErrMarginNotSupported
+}
+
+func (NoMargin) cancelOrder(pair string, orderId int64) error {
+	return ErrMarginNotSupported
+}
+
+func (NoMargin) getOrderStatus(pair string, orderId int64) (OrderStatus, error) {
+	return OrderStatus{}, ErrMarginNotSupported
+}
+
+func (NoMargin) placeStop(pair, side string, quantity, triggerPrice float64) (int64, error) {
+	return 0, ErrMarginNotSupported
+}
+
+func (NoMargin) cancelStop(pair string, stopId int64) error {
+	return ErrMarginNotSupported
+}
+
+func (NoMargin) getStopOrders(pair string) ([]StopOrder, error) {
+	return nil, ErrMarginNotSupported
+}
+
+func (NoMargin) getTrades(pair string, limit int) ([]Trade, error) {
+	return nil, ErrMarginNotSupported
+}
+
+// OrderRejectedError is returned before sending an order that the exchange would refuse
+type OrderRejectedError struct {
+	Pair   string
+	Reason string
+}
+
+func (e *OrderRejectedError) Error() string {
+	return fmt.Sprintf("order %s rejected: %s", e.Pair, e.Reason)
+}
+
+// PairInfo has the exchange limits of the pair, fees are fractions
+type PairInfo struct {
+	MinQuantity       float64
+	QuantityPrecision int
+	TakerFee          float64
+	MakerFee          float64
+}
+
+func (info PairInfo) roundQuantity(quantity float64) float64 {
+	pow := math.Pow10(info.QuantityPrecision)
+	return math.Floor(quantity*pow) / pow
+}
+
+// OrderStatus has the filled part of the order, Fee is in the right currency and zero when the exchange does not report it
+type OrderStatus struct {
+	Open     bool
+	Quantity float64
+	Amount   float64
+	Fee      float64
+}
+
+type StopOrder struct {
+	Id           int64
+	Side         string
+	Quantity     float64
+	TriggerPrice float64
+}
+
+// Trade is a fill of the order, StopId is the stop order that created it. Fee is in the right currency
+type Trade struct {
+	Id       int64
+	Date     int64
+	Side     string
+	OrderId  int64
+	StopId   int64
+	Quantity float64
+	Price    float64
+	Amount   float64
+	Fee      float64
 }
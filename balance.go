@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Balance struct {
+	Available float64
+	Reserved  float64
+}
+
+// Balances holds every currency of the account, unknown currencies are zero
+type Balances map[Currency]Balance
+
+func newBalances(available, reserved map[Currency]string) Balances {
+	balances := make(Balances)
+	for currency, amount := range available {
+		balances.add(currency, s2f(amount), 0)
+	}
+	for currency, amount := range reserved {
+		balances.add(currency, 0, s2f(amount))
+	}
+	return balances
+}
+
+func (balances Balances) available(currency Currency) float64 {
+	return balances[currency].Available
+}
+
+func (balances Balances) add(currency Currency, available, reserved float64) {
+	balance := balances[currency]
+	balance.Available += available
+	balance.Reserved += reserved
+	balances[currency] = balance
+}
+
+func (balances Balances) String() string {
+	var currencies []string
+	for currency, balance := range balances {
+		if balance.Available != 0 || balance.Reserved != 0 {
+			currencies = append(currencies, string(currency))
+		}
+	}
+	sort.Strings(currencies)
+
+	items := make([]string, len(currencies))
+	for i, currency := range currencies {
+		balance := balances[Currency(currency)]
+		if balance.Reserved != 0 {
+			items[i] = fmt.Sprintf("%s:%v (%v)", currency, balance.Available, balance.Reserved)
+		} else {
+			items[i] = fmt.Sprintf("%s:%v", currency, balance.Available)
+		}
+	}
+	return "{" + strings.Join(items, " ") + "}"
+}
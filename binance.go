@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	bn "github.com/adshao/go-binance/v2"
+	"github.com/adshao/go-binance/v2/common"
+	"github.com/fatih/color"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// binance allows 1200 request weight per minute, klines and orders weigh 1-2
+const binanceRequestsPerSecond = 10
+
+var binanceLimiter = newRateLimiter(binanceRequestsPerSecond, binanceRequestsPerSecond)
+
+func (binance *Binance) init(account *Account) *Binance {
+	binance.Account = account.Name
+	binance.Key = account.env("binance.key")
+	binance.Secret = account.env("binance.secret")
+	binance.Balance = make(Balances)
+	binance.Symbols = make(map[string]bn.Symbol)
+
+	binance.client = bn.NewClient(binance.Key, binance.Secret)
+	binance.client.HTTPClient = &http.Client{
+		Transport: &RetryTransport{
+			Limiter: binanceLimiter,
+			Backoff: defaultBackoff,
+			Stats:   &binance.Stats,
+			Sign:    binance.resign,
+		},
+	}
+	if baseUrl := account.setting("binance.url"); baseUrl != "" {
+		binance.client.BaseURL = baseUrl
+	}
+
+	if err := binance.apiGetUserInfo(); err != nil {
+		color.HiRed("ERROR account %+v", err)
+	}
+	binance.Orders = newClientOrders(accountFileName(binance.Account, "binance_orders.dat"))
+	binance.Orders.checkPending(binance.findClientOrder)
+
+	return binance
+}
+
+func (binance *Binance) showBalance() {
+	color.HiYellow("Balance %s", binance.Balance)
+	color.HiYellow("Api %s", &binance.Stats)
+}
+
+func (binance *Binance) getFileName() string {
+	return accountFileName(binance.Account, "binance.dat")
+}
+
+func (binance *Binance) downloadHistoryCandlesForStrategies(strategies []Strategy) {
+	for _, strategy := range strategies {
+		strategy.updateCandles(binance.downloadPairCandles)
+	}
+}
+
+func (binance *Binance) downloadPairCandles(candleData *CandleData) {
+	const limit = 1000
+
+	endDate := time.Now().Unix()
+	startDate := candleData.restoreHistory().Unix()
+
+	for startDate < endDate {
+		from := startDate
+		to := startDate + limit*candleData.Resolution.seconds()
+
+		klines := binance.apiGetCandles(candleData.Pair, candleData.Resolution, from, to)
+
+		startDate = to
+
+		if len(klines) == 0 {
+			continue
+		}
+		for _, k := range klines {
+			candleData.upsertCandle(k.transform())
+		}
+		fmt.Printf("%s - %s +%d\n",
+			time.Unix(from, 0).Format("02.01.06 15"),
+			time.Unix(to, 0).Format("02.01.06 15"),
+			len(klines),
+		)
+	}
+	fmt.Printf("Кол-во свечей: %d\n", candleData.len())
+
+	candleData.fillGaps(binance.candlesDownloader(candleData))
+	candleData.fillIndicators()
+	candleData.backup()
+}
+
+// candlesDownloader requests the missing candles of a gap
+func (binance *Binance) candlesDownloader(candleData *CandleData) func(from, to time.Time) []Candle {
+	return func(from, to time.Time) []Candle {
+		var candles []Candle
+		for _, k := range binance.apiGetCandles(candleData.Pair, candleData.Resolution, from.Unix(), to.Unix()) {
+			candles = append(candles, k.transform())
+		}
+		return candles
+	}
+}
+
+func (binance *Binance) downloadNewCandleForStrategies(strategies []Strategy) {
+	for _, strategy := range strategies {
+		candle := binance.downloadNewCandle(-1, strategy.Pair, strategy.Resolution)
+
+		if !candle.isEmpty() {
+			strategy.updateCandles(func(candleData *CandleData) {
+				// the history failed to download at the start, it is requested again instead of the one candle
+				if candleData.len() == 0 {
+					binance.downloadPairCandles(candleData)
+					return
+				}
+				candleData.upsertCandle(candle)
+				candleData.fillGaps(binance.candlesDownloader(candleData))
+				candleData.backup()
+			})
+		}
+	}
+}
+
+func (binance *Binance) downloadNewCandle(index int64, pair string, resolution Resolution) Candle {
+	step := resolution.seconds()
+	dt := ((time.Now().Unix() / step) + index) * step
+
+	for i := 1; i <= 50; i++ {
+		klines := binance.apiGetCandles(pair, resolution, dt, dt)
+		if len(klines) > 0 {
+			return klines[0].transform()
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+
+	return Candle{}
+}
+
+// listenPrices does nothing: binance prices are only checked at the candle boundaries
+func (binance *Binance) listenPrices(strategies []Strategy, onTick func(pair string, price, quantity float64, t time.Time, isTrade bool)) {
+}
+
+func (binance *Binance) apiGetCandles(pair string, resolution Resolution, from, to int64) []BinanceKline {
+	klines, err := binance.client.NewKlinesService().
+		Symbol(binance.symbol(pair)).
+		Interval(binanceIntervals[resolution]).
+		StartTime(from * 1000).
+		EndTime(to * 1000).
+		Limit(1000).
+		Do(context.Background())
+	if err != nil {
+		color.HiRed("ERROR candles %s %+v", pair, err)
+		return nil
+	}
+
+	result := make([]BinanceKline, len(klines))
+	for i, k := range klines {
+		result[i] = BinanceKline(*k)
+	}
+	return result
+}
+
+func (binance *Binance) apiBuy(pair string, money float64) (*bn.CreateOrderResponse, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	return binance.apiCreateOrder(pair, "buy", binance.client.NewCreateOrderService().
+		Symbol(symbol.Symbol).
+		Side(bn.SideTypeBuy).
+		Type(bn.OrderTypeMarket).
+		QuoteOrderQty(floorDecimals(money, symbol.QuoteAssetPrecision)))
+}
+
+func (binance *Binance) apiMarketOrder(pair, side string, quantity float64) (*bn.CreateOrderResponse, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	return binance.apiCreateOrder(pair, side, binance.client.NewCreateOrderService().
+		Symbol(symbol.Symbol).
+		Side(binanceSide(side)).
+		Type(bn.OrderTypeMarket).
+		Quantity(roundStep(quantity, symbol.LotSizeFilter().StepSize)))
+}
+
+func (binance *Binance) apiLimitOrder(pair, side string, quantity, price float64) (*bn.CreateOrderResponse, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	return binance.apiCreateOrder(pair, side, binance.client.NewCreateOrderService().
+		Symbol(symbol.Symbol).
+		Side(binanceSide(side)).
+		Type(bn.OrderTypeLimit).
+		TimeInForce(bn.TimeInForceTypeGTC).
+		Quantity(roundStep(quantity, symbol.LotSizeFilter().StepSize)).
+		Price(roundStep(price, symbol.PriceFilter().TickSize)))
+}
+
+func (binance *Binance) apiSetStopLoss(pair, side string, coins float64, price float64) (*bn.CreateOrderResponse, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	return binance.apiCreateOrder(pair, side, binance.client.NewCreateOrderService().
+		Symbol(symbol.Symbol).
+		Side(binanceSide(side)).
+		Type(bn.OrderTypeStopLoss).
+		Quantity(roundStep(coins, symbol.LotSizeFilter().StepSize)).
+		StopPrice(roundStep(price, symbol.PriceFilter().TickSize)))
+}
+
+// binanceStopLimitSlippage is the room under the trigger of the stop leg of an oco, binance has only stop limit legs
+const binanceStopLimitSlippage = 0.01
+
+// apiCreateOco rests the take profit and the stop loss as one order list. The stop leg has the client id
+// of the journal and the limit leg the same id with "tp", after a network failure they are looked up by the ids
+func (binance *Binance) apiCreateOco(pair, side string, quantity, price, stopPrice float64) (int64, int64, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return 0, 0, err
+	}
+	stopLimitPrice := stopPrice * (1 - binanceStopLimitSlippage)
+	if side == "buy" {
+		stopLimitPrice = stopPrice * (1 + binanceStopLimitSlippage)
+	}
+	clientId, err := binance.Orders.add(pair, side, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	stopClientId, limitClientId := i2s(clientId), i2s(clientId)+"tp"
+	tickSize := symbol.PriceFilter().TickSize
+	service := binance.client.NewCreateOCOService().
+		Symbol(symbol.Symbol).
+		Side(binanceSide(side)).
+		Quantity(roundStep(quantity, symbol.LotSizeFilter().StepSize)).
+		Price(roundStep(price, tickSize)).
+		StopPrice(roundStep(stopPrice, tickSize)).
+		StopLimitPrice(roundStep(stopLimitPrice, tickSize)).
+		StopLimitTimeInForce(bn.TimeInForceTypeGTC).
+		LimitClientOrderID(limitClientId).
+		StopClientOrderID(stopClientId)
+
+	var response *bn.CreateOCOResponse
+	unknown := false
+	for attempt := 0; attempt < defaultBackoff.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(defaultBackoff.delay(attempt - 1))
+			stopId, found, findErr := binance.findClientOrder(ClientOrder{Id: clientId, Pair: pair, Type: side})
+			if findErr == nil && found {
+				var limit *bn.Order
+				limit, findErr = binance.client.NewGetOrderService().
+					Symbol(symbol.Symbol).
+					OrigClientOrderID(limitClientId).
+					Do(context.Background())
+				if findErr == nil {
+					color.HiYellow("OCO %d/%d of client id %d is found after the failure", limit.OrderID, stopId, clientId)
+					binance.Orders.done(clientId)
+					return limit.OrderID, stopId, nil
+				}
+			}
+			if findErr != nil {
+				err = binanceError(findErr)
+				continue
+			}
+		}
+		response, err = service.Do(context.Background())
+		var apiError *common.APIError
+		if err == nil || errors.As(err, &apiError) {
+			unknown = false
+			break
+		}
+		unknown = true
+	}
+	if !unknown {
+		binance.Orders.done(clientId)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var limitId, stopId int64
+	for _, order := range response.Orders {
+		switch order.ClientOrderID {
+		case limitClientId:
+			limitId = order.OrderID
+		case stopClientId:
+			stopId = order.OrderID
+		}
+	}
+	return limitId, stopId, nil
+}
+
+// apiCreateOrder tags the order with a client id saved before sending. After a network failure the order
+// is looked up by the id and sent again only when binance does not know it
+func (binance *Binance) apiCreateOrder(pair, side string, service *bn.CreateOrderService) (*bn.CreateOrderResponse, error) {
+	clientId, err := binance.Orders.add(pair, side, false)
+	if err != nil {
+		return nil, err
+	}
+	service.NewClientOrderID(i2s(clientId))
+	order := ClientOrder{Id: clientId, Pair: pair, Type: side}
+
+	var response *bn.CreateOrderResponse
+	unknown := false
+	for attempt := 0; attempt < defaultBackoff.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(defaultBackoff.delay(attempt - 1))
+			orderId, found, findErr := binance.findClientOrder(order)
+			if findErr != nil {
+				err = findErr
+				continue
+			}
+			if found {
+				color.HiYellow("ORDER %d of client id %d is found after the failure", orderId, clientId)
+				binance.Orders.done(clientId)
+				return &bn.CreateOrderResponse{Symbol: binance.symbol(pair), OrderID: orderId, ClientOrderID: i2s(clientId)}, nil
+			}
+		}
+		response, err = service.Do(context.Background())
+		var apiError *common.APIError
+		if err == nil || errors.As(err, &apiError) {
+			unknown = false
+			break
+		}
+		unknown = true
+	}
+	if !unknown {
+		binance.Orders.done(clientId)
+	}
+
+	return response, err
+}
+
+func (binance *Binance) findClientOrder(order ClientOrder) (int64, bool, error) {
+	found, err := binance.client.NewGetOrderService().
+		Symbol(binance.symbol(order.Pair)).
+		OrigClientOrderID(i2s(order.Id)).
+		Do(context.Background())
+	if err = binanceError(err); errors.Is(err, ErrOrderNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return found.OrderID, true, nil
+}
+
+func (binance *Binance) apiCancelOrder(pair string, orderId int64) error {
+	_, err := binance.client.NewCancelOrderService().
+		Symbol(binance.symbol(pair)).
+		OrderID(orderId).
+		Do(context.Background())
+
+	return binanceError(err)
+}
+
+func (binance *Binance) apiGetOrder(pair string, orderId int64) (*bn.Order, error) {
+	order, err := binance.client.NewGetOrderService().
+		Symbol(binance.symbol(pair)).
+		OrderID(orderId).
+		Do(context.Background())
+
+	return order, binanceError(err)
+}
+
+func (binance *Binance) apiGetOpenOrders(pair string) ([]*bn.Order, error) {
+	return binance.client.NewListOpenOrdersService().
+		Symbol(binance.symbol(pair)).
+		Do(context.Background())
+}
+
+func (binance *Binance) apiGetTrades(pair string, limit int) ([]*bn.TradeV3, error) {
+	return binance.client.NewListTradesService().
+		Symbol(binance.symbol(pair)).
+		Limit(limit).
+		Do(context.Background())
+}
+
+func (binance *Binance) apiGetBookTicker(pair string) (*bn.BookTicker, error) {
+	tickers, err := binance.client.NewListBookTickersService().
+		Symbol(binance.symbol(pair)).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if len(tickers) == 0 {
+		return nil, fmt.Errorf("no book ticker for %s", pair)
+	}
+	return tickers[0], nil
+}
+
+func (binance *Binance) apiGetUserInfo() error {
+	account, err := binance.client.NewGetAccountService().Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	balances := make(Balances)
+	for _, b := range account.Balances {
+		balances.add(Currency(b.Asset), s2f(b.Free), s2f(b.Locked))
+	}
+	binance.Balance = balances
+
+	return nil
+}
+
+func (binance *Binance) apiGetSymbol(pair string) (bn.Symbol, error) {
+	name := binance.symbol(pair)
+	if symbol, ok := binance.Symbols[name]; ok {
+		return symbol, nil
+	}
+
+	info, err := binance.client.NewExchangeInfoService().Symbol(name).Do(context.Background())
+	if err != nil {
+		return bn.Symbol{}, err
+	}
+	for _, symbol := range info.Symbols {
+		binance.Symbols[symbol.Symbol] = symbol
+	}
+
+	symbol, ok := binance.Symbols[name]
+	if !ok {
+		return bn.Symbol{}, fmt.Errorf("unknown symbol %s", name)
+	}
+	return symbol, nil
+}
+
+// resign renews the timestamp and the signature of a signed request before a retry,
+// otherwise the retries of a slow request fall out of the 5 seconds recvWindow
+func (binance *Binance) resign(req *http.Request) *http.Request {
+	query := req.URL.Query()
+	if query.Get("signature") == "" {
+		return req
+	}
+	query.Del("signature")
+	query.Set("timestamp", i2s(time.Now().UnixMilli()-binance.client.TimeOffset))
+	raw := query.Encode()
+
+	mac := hmac.New(sha256.New, []byte(binance.Secret))
+	mac.Write([]byte(raw))
+	signed := req.Clone(req.Context())
+	signed.URL.RawQuery = raw + "&signature=" + hex.EncodeToString(mac.Sum(nil))
+	return signed
+}
+
+// binanceError lets errors.Is match unknown orders with ErrOrderNotFound
+func binanceError(err error) error {
+	var apiError *common.APIError
+	if errors.As(err, &apiError) && (apiError.Code == -2011 || apiError.Code == -2013) {
+		return fmt.Errorf("%w: %v", ErrOrderNotFound, err)
+	}
+	return err
+}
+
+func binanceSide(side string) bn.SideType {
+	if side == "buy" {
+		return bn.SideTypeBuy
+	}
+	return bn.SideTypeSell
+}
+
+// roundStep rounds value down to the step ("0.00100000") and formats it with the step precision.
+func roundStep(value float64, step string) string {
+	step = strings.TrimRight(step, "0")
+	decimals := 0
+	if i := strings.Index(step, "."); i >= 0 {
+		decimals = len(step) - i - 1
+	}
+	stepValue := s2f(step)
+	if stepValue > 0 {
+		value = math.Floor(value/stepValue+1e-9) * stepValue
+	}
+	return formatFloat(value, decimals)
+}
+
+func floorDecimals(value float64, decimals int) string {
+	pow := math.Pow10(decimals)
+	return formatFloat(math.Floor(value*pow)/pow, decimals)
+}
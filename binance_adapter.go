@@ -0,0 +1,176 @@
+package main
+
+import (
+	bn "github.com/adshao/go-binance/v2"
+	"strings"
+)
+
+// binanceFee is the default spot fee of makers and takers without BNB discounts
+const binanceFee = 0.001
+
+// the methods below implement the order primitives of ApiInterface on top of the binance api
+
+func (binance *Binance) String() string {
+	return "binance " + binance.Stats.String()
+}
+
+func (binance *Binance) getBalances() (Balances, error) {
+	if err := binance.apiGetUserInfo(); err != nil {
+		return nil, err
+	}
+	return binance.Balance, nil
+}
+
+func (binance *Binance) getPairInfo(pair string) (PairInfo, error) {
+	symbol, err := binance.apiGetSymbol(pair)
+	if err != nil {
+		return PairInfo{}, err
+	}
+	lotSize := symbol.LotSizeFilter()
+	precision := 0
+	if step := strings.TrimRight(lotSize.StepSize, "0"); strings.Contains(step, ".") {
+		precision = len(step) - strings.Index(step, ".") - 1
+	}
+	return PairInfo{
+		MinQuantity:       s2f(lotSize.MinQuantity),
+		QuantityPrecision: precision,
+		TakerFee:          binanceFee,
+		MakerFee:          binanceFee,
+	}, nil
+}
+
+func (binance *Binance) getBestBid(pair string) (float64, error) {
+	ticker, err := binance.apiGetBookTicker(pair)
+	if err != nil {
+		return 0, err
+	}
+	return s2f(ticker.BidPrice), nil
+}
+
+func (binance *Binance) marketBuyTotal(pair string, money, price float64) (int64, error) {
+	order, err := binance.apiBuy(pair, money)
+	if err != nil {
+		return 0, err
+	}
+	return order.OrderID, nil
+}
+
+func (binance *Binance) placeMarketOrder(pair, side string, quantity, price float64) (int64, error) {
+	order, err := binance.apiMarketOrder(pair, side, quantity)
+	if err != nil {
+		return 0, err
+	}
+	return order.OrderID, nil
+}
+
+func (binance *Binance) placeLimitOrder(pair, side string, quantity, price float64) (int64, error) {
+	order, err := binance.apiLimitOrder(pair, side, quantity, price)
+	if err != nil {
+		return 0, err
+	}
+	return order.OrderID, nil
+}
+
+func (binance *Binance) cancelOrder(pair string, orderId int64) error {
+	return binance.apiCancelOrder(pair, orderId)
+}
+
+func (binance *Binance) getOrderStatus(pair string, orderId int64) (OrderStatus, error) {
+	order, err := binance.apiGetOrder(pair, orderId)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	return OrderStatus{
+		Open:     order.Status == bn.OrderStatusTypeNew || order.Status == bn.OrderStatusTypePartiallyFilled,
+		Quantity: s2f(order.ExecutedQuantity),
+		Amount:   s2f(order.CummulativeQuoteQuantity),
+	}, nil
+}
+
+func (binance *Binance) placeStop(pair, side string, quantity, triggerPrice float64) (int64, error) {
+	order, err := binance.apiSetStopLoss(pair, side, quantity, triggerPrice)
+	if err != nil {
+		return 0, err
+	}
+	return order.OrderID, nil
+}
+
+// placeOco: the legs share the coins, binance cancels the list when one of them is filled or cancelled
+func (binance *Binance) placeOco(pair, side string, quantity, takeProfitPrice, stopLossPrice float64) (int64, int64, error) {
+	return binance.apiCreateOco(pair, side, quantity, takeProfitPrice, stopLossPrice)
+}
+
+func (binance *Binance) cancelStop(pair string, stopId int64) error {
+	return binance.apiCancelOrder(pair, stopId)
+}
+
+func (binance *Binance) getStopOrders(pair string) ([]StopOrder, error) {
+	orders, err := binance.apiGetOpenOrders(pair)
+	if err != nil {
+		return nil, err
+	}
+
+	var stopOrders []StopOrder
+	for _, order := range orders {
+		// the stop leg of an oco is a stop limit
+		if order.Type != bn.OrderTypeStopLoss && order.Type != bn.OrderTypeStopLossLimit {
+			continue
+		}
+		stopOrders = append(stopOrders, StopOrder{
+			Id:           order.OrderID,
+			Side:         strings.ToLower(string(order.Side)),
+			Quantity:     s2f(order.OrigQuantity),
+			TriggerPrice: s2f(order.StopPrice),
+		})
+	}
+	return stopOrders, nil
+}
+
+// getTrades: a triggered stop loss is filled by the stop order itself, so every trade is its own stop
+func (binance *Binance) getTrades(pair string, limit int) ([]Trade, error) {
+	response, err := binance.apiGetTrades(pair, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	trades := make([]Trade, 0, len(response))
+	for i := len(response) - 1; i >= 0; i-- {
+		trade := response[i]
+		side := "sell"
+		if trade.IsBuyer {
+			side = "buy"
+		}
+		trades = append(trades, Trade{
+			Id:       trade.ID,
+			Date:     trade.Time / 1000,
+			Side:     side,
+			OrderId:  trade.OrderID,
+			StopId:   trade.OrderID,
+			Quantity: s2f(trade.Quantity),
+			Price:    s2f(trade.Price),
+			Amount:   s2f(trade.QuoteQuantity),
+			Fee:      binance.tradeFee(pair, trade),
+		})
+	}
+	return trades, nil
+}
+
+// tradeFee converts the commission to the right currency, it may be paid in coins or BNB
+func (binance *Binance) tradeFee(pair string, trade *bn.TradeV3) float64 {
+	left, right := getCurrencies(pair)
+	switch Currency(trade.CommissionAsset) {
+	case right:
+		return s2f(trade.Commission)
+	case left:
+		return s2f(trade.Commission) * s2f(trade.Price)
+	}
+	return s2f(trade.QuoteQuantity) * binanceFee
+}
+
+func (binance *Binance) foundOrders() []ClientOrder {
+	return binance.Orders.takeFound()
+}
+
+func (binance *Binance) margin() OrderApi {
+	return NoMargin{}
+}
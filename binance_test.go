@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bn "github.com/adshao/go-binance/v2"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBinanceKey    = "key"
+	testBinanceSecret = "secret"
+)
+
+// FakeBinance serves the part of the binance spot api the adapter uses: hourly klines of a sine price,
+// orders and oco lists of one symbol, the account and the exchange info. Signed requests are checked like binance does
+type FakeBinance struct {
+	sync.Mutex
+	Orders        map[int64]*bn.Order
+	Trades        []*bn.TradeV3
+	LastOrderId   int64
+	LastListId    int64
+	Created       []url.Values
+	KlineRequests int
+	// DropOrders is the number of the next created orders whose response is lost with the connection
+	DropOrders int
+	// FailRequests is the number of the next requests answered by 503
+	FailRequests int
+	// RecvWindow is the lifetime of a signed request in milliseconds, 5 seconds by default
+	RecvWindow int64
+}
+
+func newFakeBinanceServer(t *testing.T) (*FakeBinance, *httptest.Server) {
+	fake := &FakeBinance{Orders: make(map[int64]*bn.Order)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fake *FakeBinance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// binance takes the params of the orders in the body, delete ones too
+	body, _ := io.ReadAll(r.Body)
+	params := r.URL.Query()
+	form, _ := url.ParseQuery(string(body))
+	for key, values := range form {
+		params[key] = values
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	if fake.FailRequests > 0 {
+		fake.FailRequests--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if params.Get("signature") != "" {
+		if err := fake.checkSignature(r, params, string(body)); err != nil {
+			fake.error(w, err.code, err.msg)
+			return
+		}
+	}
+
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v3/klines":
+		fake.KlineRequests++
+		fake.json(w, fake.klines(params))
+	case "GET /api/v3/exchangeInfo":
+		fake.json(w, map[string]interface{}{"symbols": []map[string]interface{}{{
+			"symbol":              "BTCUSDT",
+			"status":              "TRADING",
+			"baseAsset":           "BTC",
+			"quoteAsset":          "USDT",
+			"baseAssetPrecision":  8,
+			"quoteAssetPrecision": 8,
+			"filters": []map[string]interface{}{
+				{"filterType": "LOT_SIZE", "minQty": "0.00001000", "maxQty": "9000.00000000", "stepSize": "0.00001000"},
+				{"filterType": "PRICE_FILTER", "minPrice": "0.01000000", "maxPrice": "1000000.00000000", "tickSize": "0.01000000"},
+			},
+		}}})
+	case "GET /api/v3/account":
+		fake.json(w, map[string]interface{}{"balances": []map[string]string{
+			{"asset": "USDT", "free": "1000.00000000", "locked": "0.00000000"},
+			{"asset": "BTC", "free": "0.50000000", "locked": "0.00000000"},
+		}})
+	case "POST /api/v3/order":
+		fake.createOrder(w, params)
+	case "POST /api/v3/order/oco":
+		fake.createOco(w, params)
+	case "GET /api/v3/order":
+		if order := fake.findOrder(params); order != nil {
+			fake.json(w, order)
+			return
+		}
+		fake.error(w, -2013, "Order does not exist.")
+	case "DELETE /api/v3/order":
+		order := fake.findOrder(params)
+		if order == nil || order.Status != bn.OrderStatusTypeNew {
+			fake.error(w, -2011, "Unknown order sent.")
+			return
+		}
+		// a leg cancels the whole list
+		for _, leg := range fake.listOrders(order) {
+			leg.Status = bn.OrderStatusTypeCanceled
+		}
+		fake.json(w, order)
+	case "GET /api/v3/openOrders":
+		var orders []*bn.Order
+		for _, order := range fake.sortedOrders() {
+			if order.Status == bn.OrderStatusTypeNew && order.Symbol == params.Get("symbol") {
+				orders = append(orders, order)
+			}
+		}
+		fake.json(w, orders)
+	case "GET /api/v3/myTrades":
+		trades := []*bn.TradeV3{}
+		for _, trade := range fake.Trades {
+			if trade.Symbol == params.Get("symbol") {
+				trades = append(trades, trade)
+			}
+		}
+		fake.json(w, trades)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type fakeBinanceError struct {
+	code int64
+	msg  string
+}
+
+// checkSignature verifies the hmac of the query and the body and the time of the request
+func (fake *FakeBinance) checkSignature(r *http.Request, params url.Values, body string) *fakeBinanceError {
+	query := r.URL.RawQuery
+	i := strings.LastIndex(query, "&signature=")
+	if i < 0 {
+		return &fakeBinanceError{-1022, "Signature for this request is not valid."}
+	}
+	signature := query[i+len("&signature="):]
+	raw := query[:i] + body
+	mac := hmac.New(sha256.New, []byte(testBinanceSecret))
+	mac.Write([]byte(raw))
+	if hex.EncodeToString(mac.Sum(nil)) != signature || r.Header.Get("X-MBX-APIKEY") != testBinanceKey {
+		return &fakeBinanceError{-1022, "Signature for this request is not valid."}
+	}
+	recvWindow := fake.RecvWindow
+	if recvWindow == 0 {
+		recvWindow = 5000
+	}
+	if timestamp := s2i(params.Get("timestamp")); time.Now().UnixMilli()-timestamp > recvWindow {
+		return &fakeBinanceError{-1021, "Timestamp for this request is outside of the recvWindow."}
+	}
+	return nil
+}
+
+// klines are hourly with the open time in [startTime, endTime], at most limit of them
+func (fake *FakeBinance) klines(params url.Values) [][]interface{} {
+	const hour = int64(time.Hour / time.Millisecond)
+	from := (s2i(params.Get("startTime")) + hour - 1) / hour * hour
+	to := s2i(params.Get("endTime"))
+	limit := int(s2i(params.Get("limit")))
+
+	var klines [][]interface{}
+	for t := from; t <= to && t <= time.Now().UnixMilli() && len(klines) < limit; t += hour {
+		price := 100 + 10*math.Sin(float64(t/hour)/10)
+		klines = append(klines, []interface{}{
+			t, f2s(price), f2s(price + 1), f2s(price - 1), f2s(price + 0.5), "10.5",
+			t + hour - 1, "1000", 10, "5", "500", "0",
+		})
+	}
+	return klines
+}
+
+func (fake *FakeBinance) createOrder(w http.ResponseWriter, params url.Values) {
+	fake.Created = append(fake.Created, params)
+	for _, order := range fake.Orders {
+		if order.ClientOrderID == params.Get("newClientOrderId") {
+			fake.error(w, -2010, "Duplicate order sent.")
+			return
+		}
+	}
+
+	fake.LastOrderId++
+	order := &bn.Order{
+		Symbol:        params.Get("symbol"),
+		OrderID:       fake.LastOrderId,
+		ClientOrderID: params.Get("newClientOrderId"),
+		Price:         params.Get("price"),
+		OrigQuantity:  params.Get("quantity"),
+		Status:        bn.OrderStatusTypeNew,
+		TimeInForce:   bn.TimeInForceType(params.Get("timeInForce")),
+		Type:          bn.OrderType(params.Get("type")),
+		Side:          bn.SideType(params.Get("side")),
+		StopPrice:     params.Get("stopPrice"),
+		Time:          time.Now().UnixMilli(),
+	}
+	if order.Type == bn.OrderTypeMarket {
+		order.Status = bn.OrderStatusTypeFilled
+		order.ExecutedQuantity = order.OrigQuantity
+	}
+	fake.Orders[order.OrderID] = order
+
+	if fake.DropOrders > 0 {
+		fake.DropOrders--
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			panic("no hijacker")
+		}
+		conn, _, _ := hijacker.Hijack()
+		_ = conn.Close()
+		return
+	}
+	fake.json(w, bn.CreateOrderResponse{
+		Symbol:        order.Symbol,
+		OrderID:       order.OrderID,
+		ClientOrderID: order.ClientOrderID,
+		TransactTime:  order.Time,
+		Status:        order.Status,
+		Type:          order.Type,
+		Side:          order.Side,
+	})
+}
+
+// createOco rests a limit maker and a stop loss limit with the same list id
+func (fake *FakeBinance) createOco(w http.ResponseWriter, params url.Values) {
+	fake.Created = append(fake.Created, params)
+	fake.LastListId++
+	response := bn.CreateOCOResponse{OrderListID: fake.LastListId, Symbol: params.Get("symbol")}
+	legs := []struct {
+		clientId  string
+		orderType bn.OrderType
+		price     string
+		stopPrice string
+	}{
+		{params.Get("limitClientOrderId"), bn.OrderTypeLimitMaker, params.Get("price"), ""},
+		{params.Get("stopClientOrderId"), bn.OrderTypeStopLossLimit, params.Get("stopLimitPrice"), params.Get("stopPrice")},
+	}
+	for _, leg := range legs {
+		fake.LastOrderId++
+		fake.Orders[fake.LastOrderId] = &bn.Order{
+			Symbol:        params.Get("symbol"),
+			OrderID:       fake.LastOrderId,
+			OrderListId:   fake.LastListId,
+			ClientOrderID: leg.clientId,
+			Price:         leg.price,
+			OrigQuantity:  params.Get("quantity"),
+			Status:        bn.OrderStatusTypeNew,
+			Type:          leg.orderType,
+			Side:          bn.SideType(params.Get("side")),
+			StopPrice:     leg.stopPrice,
+			Time:          time.Now().UnixMilli(),
+		}
+		response.Orders = append(response.Orders, &bn.OCOOrder{
+			Symbol:        params.Get("symbol"),
+			OrderID:       fake.LastOrderId,
+			ClientOrderID: leg.clientId,
+		})
+	}
+	fake.json(w, response)
+}
+
+// listOrders are the legs of the list of the order, or the order itself
+func (fake *FakeBinance) listOrders(order *bn.Order) []*bn.Order {
+	if order.OrderListId <= 0 {
+		return []*bn.Order{order}
+	}
+	var orders []*bn.Order
+	for _, leg := range fake.sortedOrders() {
+		if leg.OrderListId == order.OrderListId {
+			orders = append(orders, leg)
+		}
+	}
+	return orders
+}
+
+// fill executes the order at the price with the fee in the quote asset, the other legs of its list expire
+func (fake *FakeBinance) fill(orderId int64, price float64) {
+	order := fake.Orders[orderId]
+	for _, leg := range fake.listOrders(order) {
+		leg.Status = bn.OrderStatusTypeExpired
+	}
+	quantity := s2f(order.OrigQuantity)
+	order.Status = bn.OrderStatusTypeFilled
+	order.ExecutedQuantity = order.OrigQuantity
+	order.CummulativeQuoteQuantity = f2s(quantity * price)
+	fake.Trades = append(fake.Trades, &bn.TradeV3{
+		ID:              int64(len(fake.Trades) + 1),
+		Symbol:          order.Symbol,
+		OrderID:         order.OrderID,
+		OrderListId:     order.OrderListId,
+		Price:           f2s(price),
+		Quantity:        order.OrigQuantity,
+		QuoteQuantity:   f2s(quantity * price),
+		Commission:      f2s(quantity * price * binanceFee),
+		CommissionAsset: "USDT",
+		Time:            time.Now().UnixMilli(),
+		IsBuyer:         order.Side == bn.SideTypeBuy,
+	})
+}
+
+func (fake *FakeBinance) findOrder(params url.Values) *bn.Order {
+	for _, order := range fake.Orders {
+		if order.Symbol != params.Get("symbol") {
+			continue
+		}
+		if id := params.Get("orderId"); id != "" && order.OrderID == s2i(id) {
+			return order
+		}
+		if id := params.Get("origClientOrderId"); id != "" && order.ClientOrderID == id {
+			return order
+		}
+	}
+	return nil
+}
+
+func (fake *FakeBinance) sortedOrders() []*bn.Order {
+	var orders []*bn.Order
+	for _, order := range fake.Orders {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].OrderID < orders[j].OrderID })
+	return orders
+}
+
+func (fake *FakeBinance) json(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func (fake *FakeBinance) error(w http.ResponseWriter, code int64, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = fmt.Fprintf(w, `{"code":%d,"msg":%q}`, code, msg)
+}
+
+// inTempDir runs the test in an empty directory, the bot keeps its state files in the current one
+func inTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(dir) })
+}
+
+func newTestBinance(t *testing.T) (*Binance, *FakeBinance) {
+	inTempDir(t)
+	fake, server := newFakeBinanceServer(t)
+	t.Setenv("binance.key", testBinanceKey)
+	t.Setenv("binance.secret", testBinanceSecret)
+	t.Setenv("binance.url", server.URL)
+	return new(Binance).init(&Account{Name: "", Exchange: "binance"}), fake
+}
+
+func TestBinanceCandlesPaging(t *testing.T) {
+	binance, fake := newTestBinance(t)
+
+	candleData := initCandleData("binance", "BTC_USDT", "60")
+	binance.downloadPairCandles(candleData)
+
+	// two months of hourly candles take two pages of 1000
+	if fake.KlineRequests != 2 {
+		t.Errorf("kline requests %d, want 2", fake.KlineRequests)
+	}
+	if n := int64(candleData.len()); n < historyCandles-1 || n > historyCandles+1 {
+		t.Errorf("candles %d, want %d", n, historyCandles)
+	}
+	for i := 1; i < candleData.len(); i++ {
+		if step := candleData.Time[i].Sub(candleData.Time[i-1]); step != time.Hour {
+			t.Fatalf("candle %d is %s after the previous one", i, step)
+		}
+	}
+	if len(candleData.Gaps) != 0 {
+		t.Errorf("gaps %v", candleData.Gaps)
+	}
+	last := candleData.len() - 1
+	if candleData.Candles[V][last] != 10.5 || candleData.Candles[H][last]-candleData.Candles[L][last] != 2 {
+		t.Errorf("last candle %v", candleData.Time[last])
+	}
+}
+
+func TestBinanceCreateOrder(t *testing.T) {
+	binance, fake := newTestBinance(t)
+
+	orderId, err := binance.placeLimitOrder("BTC_USDT", "sell", 0.123456789, 20000.123)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := fake.Created[0]
+	if params.Get("quantity") != "0.12345" || params.Get("price") != "20000.12" || params.Get("timeInForce") != "GTC" {
+		t.Errorf("order params %v", params)
+	}
+	if params.Get("newClientOrderId") == "" {
+		t.Errorf("no client order id")
+	}
+	status, err := binance.getOrderStatus("BTC_USDT", orderId)
+	if err != nil || !status.Open {
+		t.Errorf("order status %+v %v", status, err)
+	}
+
+	// the response of the market order is lost, the order is found by its client id and not sent again
+	fake.DropOrders = 1
+	orderId, err = binance.placeMarketOrder("BTC_USDT", "buy", 0.01, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Created) != 2 || fake.Orders[orderId] == nil || fake.Orders[orderId].Type != bn.OrderTypeMarket {
+		t.Errorf("created %d orders, found %d", len(fake.Created), orderId)
+	}
+	if pending := binance.Orders.pending(); len(pending) != 0 {
+		t.Errorf("pending client orders %v", pending)
+	}
+
+	if err = binance.cancelOrder("BTC_USDT", 1); err != nil {
+		t.Errorf("cancel %v", err)
+	}
+	if _, err = binance.getOrderStatus("BTC_USDT", 100); !errors.Is(err, ErrOrderNotFound) {
+		t.Errorf("unknown order error %v", err)
+	}
+}
+
+func TestBinanceStopOrders(t *testing.T) {
+	binance, _ := newTestBinance(t)
+
+	if _, err := binance.placeLimitOrder("BTC_USDT", "sell", 0.1, 25000); err != nil {
+		t.Fatal(err)
+	}
+	stopId, err := binance.placeStop("BTC_USDT", "sell", 0.1, 18000.555)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopOrders, err := binance.getStopOrders("BTC_USDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := StopOrder{Id: stopId, Side: "sell", Quantity: 0.1, TriggerPrice: 18000.55}
+	if len(stopOrders) != 1 || stopOrders[0] != want {
+		t.Errorf("stop orders %+v, want %+v", stopOrders, want)
+	}
+
+	if err = binance.cancelStop("BTC_USDT", stopId); err != nil {
+		t.Fatal(err)
+	}
+	if stopOrders, _ = binance.getStopOrders("BTC_USDT"); len(stopOrders) != 0 {
+		t.Errorf("stop orders after cancel %+v", stopOrders)
+	}
+}
+
+// TestBinanceRetrySignedRequest: the retries take longer than the recvWindow, every one is signed again
+func TestBinanceRetrySignedRequest(t *testing.T) {
+	binance, fake := newTestBinance(t)
+
+	fake.Lock()
+	fake.RecvWindow = 400
+	fake.FailRequests = 3
+	fake.Unlock()
+	if _, err := binance.getStopOrders("BTC_USDT"); err != nil {
+		t.Fatal(err)
+	}
+	if binance.Stats.Retries != 3 {
+		t.Errorf("retries %d, want 3", binance.Stats.Retries)
+	}
+}
+
+// openBinanceLong sets the long bought before the test, the exit orders are placed as an oco list
+func openBinanceLong(t *testing.T) (*Engine, *FakeBinance) {
+	binance, fake := newTestBinance(t)
+	strategy := testStrategy("BTC_USDT", Long)
+	engine := newTestEngine(t, binance, strategy)
+	engine.setOpenedOrder(OpenedOrder{
+		Strategy:    engine.Strategies[0],
+		OpenedPrice: 100,
+		OpenedAt:    time.Now().Add(-time.Minute),
+		Quantity:    0.5,
+		EntryFee:    binanceFee,
+		ExitFee:     binanceFee,
+	})
+
+	openedOrder := engine.OpenedOrder
+	if openedOrder.StopLossOrderId == 0 || openedOrder.TakeProfitOrderId == 0 {
+		t.Fatalf("stop loss %d, take profit %d", openedOrder.StopLossOrderId, openedOrder.TakeProfitOrderId)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	takeProfit, stopLoss := fake.Orders[openedOrder.TakeProfitOrderId], fake.Orders[openedOrder.StopLossOrderId]
+	if takeProfit.OrderListId == 0 || takeProfit.OrderListId != stopLoss.OrderListId ||
+		takeProfit.Type != bn.OrderTypeLimitMaker || stopLoss.Type != bn.OrderTypeStopLossLimit {
+		t.Fatalf("take profit %+v, stop loss %+v are not one oco", takeProfit, stopLoss)
+	}
+	if s2f(takeProfit.Price) < 102 || s2f(stopLoss.StopPrice) != 80 || takeProfit.OrigQuantity != "0.49950" {
+		t.Errorf("take profit %s, stop %s, quantity %s", takeProfit.Price, stopLoss.StopPrice, takeProfit.OrigQuantity)
+	}
+	return engine, fake
+}
+
+func (fake *FakeBinance) openOrders() int {
+	fake.Lock()
+	defer fake.Unlock()
+	open := 0
+	for _, order := range fake.Orders {
+		if order.Status == bn.OrderStatusTypeNew {
+			open++
+		}
+	}
+	return open
+}
+
+// TestBinanceOcoTakeProfit: the take profit of the long is filled, the stop loss is gone with it
+func TestBinanceOcoTakeProfit(t *testing.T) {
+	engine, fake := openBinanceLong(t)
+
+	fake.Lock()
+	fake.fill(engine.OpenedOrder.TakeProfitOrderId, engine.OpenedOrder.TakeProfitPrice)
+	fake.Unlock()
+	engine.checkExitOrders()
+
+	if engine.isOrderOpened() {
+		t.Fatalf("the filled take profit is not found, stop loss %d", engine.OpenedOrder.StopLossOrderId)
+	}
+	if open := fake.openOrders(); open != 0 {
+		t.Errorf("open orders %d", open)
+	}
+}
+
+// TestBinanceOcoStopLoss: the stop loss of the long is filled, the take profit is gone with it
+func TestBinanceOcoStopLoss(t *testing.T) {
+	engine, fake := openBinanceLong(t)
+
+	fake.Lock()
+	fake.fill(engine.OpenedOrder.StopLossOrderId, 79.5)
+	fake.Unlock()
+	engine.checkExitOrders()
+
+	if engine.isOrderOpened() {
+		t.Fatalf("the filled stop loss is not found, take profit %d", engine.OpenedOrder.TakeProfitOrderId)
+	}
+	if open := fake.openOrders(); open != 0 {
+		t.Errorf("open orders %d", open)
+	}
+}
+
+// TestBinanceOcoReplaceStopLoss: the trailing stop cancels the list and places both legs again
+func TestBinanceOcoReplaceStopLoss(t *testing.T) {
+	engine, fake := openBinanceLong(t)
+	opened := engine.OpenedOrder
+
+	if err := engine.replaceStopLoss(90); err != nil {
+		t.Fatal(err)
+	}
+	openedOrder := engine.OpenedOrder
+	if openedOrder.StopLossOrderId == opened.StopLossOrderId || openedOrder.TakeProfitOrderId == opened.TakeProfitOrderId ||
+		openedOrder.StopLossPrice != 90 || openedOrder.TakeProfitPrice != opened.TakeProfitPrice {
+		t.Errorf("stop loss %d at %f, take profit %d at %f", openedOrder.StopLossOrderId, openedOrder.StopLossPrice,
+			openedOrder.TakeProfitOrderId, openedOrder.TakeProfitPrice)
+	}
+	if open := fake.openOrders(); open != 2 {
+		t.Errorf("open orders %d, want the new list", open)
+	}
+}
+
+// TestBinanceOcoCancelledByHand: the list is cancelled on the exchange, reconcile places it again
+func TestBinanceOcoCancelledByHand(t *testing.T) {
+	engine, fake := openBinanceLong(t)
+
+	fake.Lock()
+	for _, order := range fake.listOrders(fake.Orders[engine.OpenedOrder.TakeProfitOrderId]) {
+		order.Status = bn.OrderStatusTypeCanceled
+	}
+	fake.Unlock()
+	engine.checkExitOrders()
+	engine.checkExitOrders()
+
+	if !engine.isOrderOpened() || engine.OpenedOrder.TakeProfitOrderId == 0 || engine.OpenedOrder.StopLossOrderId == 0 {
+		t.Fatalf("opened %t, take profit %d, stop loss %d", engine.isOrderOpened(),
+			engine.OpenedOrder.TakeProfitOrderId, engine.OpenedOrder.StopLossOrderId)
+	}
+	if open := fake.openOrders(); open != 2 {
+		t.Errorf("open orders %d, want one list", open)
+	}
+}
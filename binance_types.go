@@ -0,0 +1,38 @@
+package main
+
+import (
+	bn "github.com/adshao/go-binance/v2"
+	"time"
+)
+
+type Binance struct {
+	Account string
+	Key     string
+	Secret  string
+	Balance Balances
+	Symbols map[string]bn.Symbol
+	Stats   ApiStats
+	Orders  *ClientOrders
+	client  *bn.Client
+}
+
+var binanceIntervals = map[Resolution]string{
+	"1":   "1m",
+	"5":   "5m",
+	"15":  "15m",
+	"30":  "30m",
+	"60":  "1h",
+	"240": "4h",
+	"D":   "1d",
+}
+
+type BinanceKline bn.Kline
+
+func (k BinanceKline) transform() Candle {
+	return newCandle(s2f(k.Low), s2f(k.Open), s2f(k.Close), s2f(k.High), s2f(k.Volume), time.Unix(k.OpenTime/1000, 0))
+}
+
+func (binance *Binance) symbol(pair string) string {
+	left, right := getCurrencies(pair)
+	return string(left + right)
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"github.com/fatih/color"
+	"math"
 	"os"
-	"reflect"
+	"sort"
 	"time"
 )
 
@@ -25,21 +26,95 @@ type Candle struct {
 	LOH float64
 	LCH float64
 	OCH float64
+	V   float64
 	T   time.Time
 }
 
+func newCandle(l, o, c, h, v float64, t time.Time) Candle {
+	return Candle{
+		l,
+		o,
+		c,
+		h,
+		(l + o) * 0.5,
+		(l + c) * 0.5,
+		(l + h) * 0.5,
+		(o + c) * 0.5,
+		(o + h) * 0.5,
+		(c + h) * 0.5,
+		(l + o + c) / 3.0,
+		(l + o + h) / 3.0,
+		(l + c + h) / 3.0,
+		(o + c + h) / 3.0,
+		v,
+		t,
+	}
+}
+
 func (candle Candle) isEmpty() bool {
 	return candle.L == 0.0
 }
 
 type CandleData struct {
+	Exchange   string
 	Pair       string
+	Resolution Resolution
 	Time       []time.Time
-	Candles    map[BarType][]float64
-	Indicators map[IndicatorType]map[int]map[BarType][]float64
+	Candles    [barTypesCount][]float64
+	Indicators [][]float64 // by indicatorKey, allocated on the first read
+	Gaps       []Gap
+
+	longIndicators map[longIndicatorKey][]float64 // periods above maxIndicatorCoef
+}
+
+// Resolution is the candle timeframe in minutes or "D", as the exmo api names it
+type Resolution string
+
+const defaultResolution Resolution = "60"
+
+var Resolutions = []Resolution{"1", "5", "15", "30", "60", "240", "D"}
+
+func (resolution Resolution) isValid() bool {
+	return sliceIndex(Resolutions, resolution) != -1
+}
+
+func (resolution Resolution) duration() time.Duration {
+	if resolution == "D" {
+		return 24 * time.Hour
+	}
+	return time.Duration(s2i(string(resolution))) * time.Minute
+}
+
+// seconds is the candle length used in the timestamp math of the exchanges
+func (resolution Resolution) seconds() int64 {
+	return int64(resolution.duration() / time.Second)
+}
+
+// historyCandles is the history depth, the same number of candles for every resolution: two months of hourly ones.
+// "history.candles" in the env changes it
+var historyCandles int64 = 60 * 24
+
+func (resolution Resolution) historyStart() time.Time {
+	return time.Now().Add(-time.Duration(historyCandles) * resolution.duration())
+}
+
+// cron fires at every candle boundary in UTC
+func (resolution Resolution) cron() string {
+	return map[Resolution]string{
+		"1":   "* * * * *",
+		"5":   "*/5 * * * *",
+		"15":  "*/15 * * * *",
+		"30":  "*/30 * * * *",
+		"60":  "0 * * * *",
+		"240": "0 */4 * * *",
+		"D":   "0 0 * * *",
+	}[resolution]
 }
 
-var CandleStorage map[string]CandleData
+// candleKey separates the exchanges, accounts of one exchange share its candles
+func candleKey(exchange, pair string, resolution Resolution) string {
+	return exchange + "_" + pair + "_" + string(resolution)
+}
 
 type BarType int8
 
@@ -58,25 +133,29 @@ const (
 	LOH
 	LCH
 	OCH
+	V // the volume is kept with the prices, so it is revised, gap filled and cached the same way
 )
 
+var barTypeNames = [barTypesCount]string{
+	L:   "L",
+	O:   "O",
+	C:   "C",
+	H:   "H",
+	LO:  "LO",
+	LC:  "LC",
+	LH:  "LH",
+	OC:  "OC",
+	OH:  "OH",
+	CH:  "CH",
+	LOC: "LOC",
+	LOH: "LOH",
+	LCH: "LCH",
+	OCH: "OCH",
+	V:   "V",
+}
+
 func (barType BarType) String() string {
-	return map[BarType]string{
-		L:   "L",
-		O:   "O",
-		C:   "C",
-		H:   "H",
-		LO:  "LO",
-		LC:  "LC",
-		LH:  "LH",
-		OC:  "OC",
-		OH:  "OH",
-		CH:  "CH",
-		LOC: "LOC",
-		LOH: "LOH",
-		LCH: "LCH",
-		OCH: "OCH",
-	}[barType]
+	return barTypeNames[barType]
 }
 
 func (barType BarType) value(s string) BarType {
@@ -95,11 +174,15 @@ func (barType BarType) value(s string) BarType {
 		"LOH": LOH,
 		"LCH": LCH,
 		"OCH": OCH,
+		"V":   V,
 	}[s]
 }
 
-var BarTypes = [14]BarType{
-	L, O, C, H, LO, LC, LH, OC, OH, CH, LOC, LOH, LCH, OCH,
+// barTypesCount is a part of the cache format, old cache files are not read and the candles are downloaded again
+const barTypesCount = 15
+
+var BarTypes = [barTypesCount]BarType{
+	L, O, C, H, LO, LC, LH, OC, OH, CH, LOC, LOH, LCH, OCH, V,
 }
 
 type IndicatorType int8
@@ -116,32 +199,110 @@ const (
 	IndicatorType2EmaTema
 	IndicatorType3EmaTema
 	IndicatorType2Tema
+	IndicatorTypeVwap
+	IndicatorTypeObv
+	IndicatorTypeVolumeSma
 )
 
+// maxIndicatorType is the last type, the number of indicator series depends on it
+const maxIndicatorType = IndicatorTypeVolumeSma
+
 var IndicatorTypes = []IndicatorType{
 	IndicatorTypeSma, IndicatorTypeEma, IndicatorTypeDema, IndicatorTypeTema, IndicatorTypeTemaZero, IndicatorType2Ema,
 	IndicatorType3Ema, IndicatorTypeEmaTema, IndicatorType2EmaTema, IndicatorType3EmaTema, IndicatorType2Tema,
+	IndicatorTypeVwap, IndicatorTypeObv, IndicatorTypeVolumeSma,
+}
+
+// indicatorTypeCandle is the source of the first ema, the candles themselves
+const indicatorTypeCandle IndicatorType = 0
+
+// emaSources is the series every ema is smoothing
+var emaSources = [...]IndicatorType{
+	IndicatorTypeEma:      indicatorTypeCandle,
+	IndicatorType2Ema:     IndicatorTypeEma,
+	IndicatorType3Ema:     IndicatorType2Ema,
+	IndicatorTypeEmaTema:  IndicatorTypeTema,
+	IndicatorType2EmaTema: IndicatorTypeEmaTema,
+	IndicatorType3EmaTema: IndicatorType2EmaTema,
+}
+
+// maxIndicatorCoef is the longest period in the flat table, the ema weights are percents.
+// Longer periods, like sma 200, are cached in a map
+const maxIndicatorCoef = 100
+
+// indicatorSlots is the number of series: every type, period and bar type
+const indicatorSlots = (int(maxIndicatorType) + 1) * (maxIndicatorCoef + 1) * barTypesCount
+
+// indicatorReserve is the room for new candles in a series, they are appended without copying
+const indicatorReserve = 256
+
+// indicatorKey is the flat index of the series in CandleData.Indicators
+func indicatorKey(indicatorType IndicatorType, n int, barType BarType) int {
+	return (int(indicatorType)*(maxIndicatorCoef+1)+n)*barTypesCount + int(barType)
+}
+
+type longIndicatorKey struct {
+	indicatorType IndicatorType
+	n             int
+	barType       BarType
+}
+
+// series is the cached part of the indicator
+func (candleData *CandleData) series(indicatorType IndicatorType, n int, barType BarType) []float64 {
+	if n > maxIndicatorCoef {
+		return candleData.longIndicators[longIndicatorKey{indicatorType, n, barType}]
+	}
+	if candleData.Indicators == nil {
+		return nil
+	}
+	return candleData.Indicators[indicatorKey(indicatorType, n, barType)]
 }
 
-func initCandleData(pair string) *CandleData {
-	candleData := CandleStorage[pair]
-	candleData.Candles = make(map[BarType][]float64)
-	candleData.Indicators = make(map[IndicatorType]map[int]map[BarType][]float64)
-	candleData.Pair = pair
-	return &candleData
+func (candleData *CandleData) setSeries(indicatorType IndicatorType, n int, barType BarType, values []float64) {
+	if n > maxIndicatorCoef {
+		if candleData.longIndicators == nil {
+			candleData.longIndicators = make(map[longIndicatorKey][]float64)
+		}
+		candleData.longIndicators[longIndicatorKey{indicatorType, n, barType}] = values
+		return
+	}
+	if candleData.Indicators == nil {
+		candleData.Indicators = make([][]float64, indicatorSlots)
+	}
+	candleData.Indicators[indicatorKey(indicatorType, n, barType)] = values
+}
+
+func initCandleData(exchange, pair string, resolution Resolution) *CandleData {
+	return &CandleData{
+		Exchange:   exchange,
+		Pair:       pair,
+		Resolution: resolution,
+	}
 }
 
-func getCandleData(pair string) *CandleData {
-	candleData, ok := CandleStorage[pair]
-	if ok == false {
-		return initCandleData(pair)
+// clone copies the candles and the gaps, indicators of the copy are calculated again when they are read.
+// All bar types share one block, so a snapshot costs the same few allocations at any history depth
+func (candleData *CandleData) clone() *CandleData {
+	clone := initCandleData(candleData.Exchange, candleData.Pair, candleData.Resolution)
+	clone.Time = append([]time.Time(nil), candleData.Time...)
+	n := candleData.len()
+	prices := make([]float64, barTypesCount*n)
+	for _, barType := range BarTypes {
+		start, end := int(barType)*n, int(barType+1)*n
+		copy(prices[start:end], candleData.Candles[barType])
+		clone.Candles[barType] = prices[start:end:end]
 	}
-	return &candleData
+	clone.Gaps = append([]Gap(nil), candleData.Gaps...)
+	return clone
+}
+
+func (candleData *CandleData) key() string {
+	return candleKey(candleData.Exchange, candleData.Pair, candleData.Resolution)
 }
 
+// restore reads the cache file once, the series already in the storage is up to date
 func (candleData *CandleData) restore() bool {
-	_, ok := CandleStorage[candleData.Pair]
-	if ok {
+	if candleData.len() > 0 {
 		return true
 	}
 
@@ -151,23 +312,64 @@ func (candleData *CandleData) restore() bool {
 	}
 	dataIn := ReadFromFile(fileName)
 	dec := gob.NewDecoder(bytes.NewReader(dataIn))
-	_ = dec.Decode(candleData)
-	candleData.save()
+	if err := dec.Decode(candleData); err != nil {
+		color.HiRed("ERROR candles cache %s %+v", fileName, err)
+		*candleData = *initCandleData(candleData.Exchange, candleData.Pair, candleData.Resolution)
+		return false
+	}
 
 	return true
 }
 
+// backup keeps only the candles, indicators are calculated again after the restore
 func (candleData *CandleData) backup() {
-	dataOut := EncodeToBytes(candleData)
+	candles := *candleData
+	candles.Indicators = nil
+	dataOut := EncodeToBytes(candles)
 	_ = os.WriteFile(candleData.getFileName(), dataOut, 0644)
 }
 
-func (candleData *CandleData) getFileName() string {
-	return fmt.Sprintf("%s_candles_%s_%s.dat", exchange, candleData.Pair, resolution)
+// restoreHistory loads the cached candles within the history depth and returns the time to download from:
+// the last cached candle, it may be unfinished, or the start of the history
+func (candleData *CandleData) restoreHistory() time.Time {
+	start := candleData.Resolution.historyStart()
+	if !candleData.restore() {
+		return start
+	}
+	candleData.trim(start)
+	// the cache is shorter than the depth, candles are only appended so it is downloaded again
+	if candleData.len() == 0 || candleData.Time[0].After(start.Add(candleData.Resolution.duration())) {
+		*candleData = *initCandleData(candleData.Exchange, candleData.Pair, candleData.Resolution)
+		return start
+	}
+	return candleData.lastTime()
+}
+
+// trim drops the candles before the start, indexes move so all indicators are calculated again
+func (candleData *CandleData) trim(start time.Time) {
+	i := sort.Search(candleData.len(), func(i int) bool {
+		return !candleData.Time[i].Before(start)
+	})
+	if i == 0 {
+		return
+	}
+	candleData.Time = candleData.Time[i:]
+	for _, barType := range BarTypes {
+		candleData.Candles[barType] = candleData.Candles[barType][i:]
+	}
+	candleData.invalidate(0)
+
+	var gaps []Gap
+	for _, gap := range candleData.Gaps {
+		if !gap.To.Before(start) {
+			gaps = append(gaps, gap)
+		}
+	}
+	candleData.Gaps = gaps
 }
 
-func (candleData *CandleData) save() {
-	CandleStorage[candleData.Pair] = *candleData
+func (candleData *CandleData) getFileName() string {
+	return fmt.Sprintf("%s_candles_%s_%s.dat", candleData.Exchange, candleData.Pair, candleData.Resolution)
 }
 
 func (candleData *CandleData) len() int {
@@ -178,6 +380,15 @@ func (candleData *CandleData) index() int {
 	return candleData.len() - 1
 }
 
+// closedIndex skips the last candle while it is still being formed
+func (candleData *CandleData) closedIndex() int {
+	i := candleData.index()
+	if i >= 0 && candleData.Time[i].Add(candleData.Resolution.duration()).After(time.Now()) {
+		return i - 1
+	}
+	return i
+}
+
 func (candleData *CandleData) lastTime() time.Time {
 	return candleData.Time[candleData.index()]
 }
@@ -188,11 +399,24 @@ func (candleData *CandleData) lastCandleValue(barType BarType) float64 {
 
 func (candleData *CandleData) upsertCandle(c Candle) bool {
 	l := candleData.index()
-	if l >= 0 && candleData.Time[l].Equal(c.T) {
-		candleData.Time[l] = c.T
-		for _, barType := range BarTypes {
-			candleData.Candles[barType][l] = c.getPrice(barType)
+	// the live candle from the stream may already follow the updated one
+	for i := l; i >= 0 && i >= l-1; i-- {
+		if candleData.Time[i].Equal(c.T) {
+			candleData.Time[i] = c.T
+			revised := false
+			for _, barType := range BarTypes {
+				if price := c.getPrice(barType); candleData.Candles[barType][i] != price {
+					candleData.Candles[barType][i] = price
+					revised = true
+				}
+			}
+			if revised {
+				candleData.invalidate(i)
+			}
+			return false
 		}
+	}
+	if l >= 0 && c.T.Before(candleData.Time[l]) {
 		return false
 	} else {
 		candleData.Time = append(candleData.Time, c.T)
@@ -203,19 +427,82 @@ func (candleData *CandleData) upsertCandle(c Candle) bool {
 	}
 }
 
+// invalidate drops the indicator values from the index on, the length of every series is its valid part.
+// They are calculated again on request, the same way as after a cold start
+func (candleData *CandleData) invalidate(i int) {
+	for key, values := range candleData.Indicators {
+		if len(values) > i {
+			candleData.Indicators[key] = values[:i]
+		}
+	}
+	for key, values := range candleData.longIndicators {
+		if len(values) > i {
+			candleData.longIndicators[key] = values[:i]
+		}
+	}
+}
+
 func (candle Candle) getPrice(barType BarType) float64 {
-	r := reflect.ValueOf(candle)
-	f := reflect.Indirect(r).FieldByName(barType.String())
-	return f.Float()
+	switch barType {
+	case L:
+		return candle.L
+	case O:
+		return candle.O
+	case C:
+		return candle.C
+	case H:
+		return candle.H
+	case LO:
+		return candle.LO
+	case LC:
+		return candle.LC
+	case LH:
+		return candle.LH
+	case OC:
+		return candle.OC
+	case OH:
+		return candle.OH
+	case CH:
+		return candle.CH
+	case LOC:
+		return candle.LOC
+	case LOH:
+		return candle.LOH
+	case LCH:
+		return candle.LCH
+	case OCH:
+		return candle.OCH
+	case V:
+		return candle.V
+	}
+	return 0
+}
+
+// atr is the simple average of true ranges of n candles up to i
+func (candleData *CandleData) atr(n, i int) float64 {
+	h, l, c := candleData.Candles[H], candleData.Candles[L], candleData.Candles[C]
+	sum, count := 0.0, 0
+	for k := i; k > i-n && k >= 0; k-- {
+		tr := h[k] - l[k]
+		if k > 0 {
+			tr = math.Max(tr, math.Max(math.Abs(h[k]-c[k-1]), math.Abs(l[k]-c[k-1])))
+		}
+		sum += tr
+		count++
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
 }
 
 func (candleData *CandleData) calculateSma(n, i int, barType BarType) float64 {
 	if i >= n {
-		return candleData.getSma(n, i-1, barType) + (candleData.getCandle(n, i, barType)-candleData.getCandle(n, i-n, barType))/float64(n)
+		return candleData.getSma(n, i-1, barType) + (candleData.Candles[barType][i]-candleData.Candles[barType][i-n])/float64(n)
 	} else if i > 0 {
-		return (candleData.getSma(n, i-1, barType)*float64(i) + candleData.getCandle(n, i, barType)) / float64(i+1)
+		return (candleData.getSma(n, i-1, barType)*float64(i) + candleData.Candles[barType][i]) / float64(i+1)
 	}
-	return candleData.getCandle(n, 0, barType)
+	return candleData.Candles[barType][0]
 }
 
 func (candleData *CandleData) calculateDema(n, i int, barType BarType) float64 {
@@ -226,9 +513,10 @@ func (candleData *CandleData) calculateTema(n, i int, barType BarType) float64 {
 	return 3*(candleData.getEma(n, i, barType)-candleData.get2Ema(n, i, barType)) + candleData.get3Ema(n, i, barType)
 }
 
-func (candleData *CandleData) calculateEma(source, prev funGet, n, i int, barType BarType) float64 {
+func (candleData *CandleData) calculateEma(indicatorType IndicatorType, n, i int, barType BarType) float64 {
 	if i > 0 {
-		return (source(n, i, barType)*float64(n) + float64(100-n)*prev(n, i-1, barType)) * 0.01
+		source := candleData.value(emaSources[indicatorType], n, i, barType)
+		return (source*float64(n) + float64(100-n)*candleData.value(indicatorType, n, i-1, barType)) * 0.01
 	}
 	return candleData.Candles[barType][i]
 }
@@ -241,99 +529,152 @@ func (candleData *CandleData) calculateTemaZero(n, i int, barType BarType) float
 	return 2*candleData.getTema(n, i, barType) - candleData.get2Tema(n, i, barType)
 }
 
-type funGet func(n, i int, barType BarType) float64
-type funEma func(source, prev funGet, n, i int, barType BarType) float64
-
-// GET
-func (candleData *CandleData) getCandle(n, i int, barType BarType) float64 {
-	return candleData.Candles[barType][i]
+// calculateVwap is the price of n candles weighted by their volume, the bar type is the price used
+func (candleData *CandleData) calculateVwap(n, i int, barType BarType) float64 {
+	prices, volumes := candleData.Candles[barType], candleData.Candles[V]
+	sum, volume := 0.0, 0.0
+	for k := i; k > i-n && k >= 0; k-- {
+		sum += prices[k] * volumes[k]
+		volume += volumes[k]
+	}
+	if volume == 0 {
+		return prices[i]
+	}
+	return sum / volume
 }
 
-func (candleData *CandleData) get(indicatorType IndicatorType, fun funGet, n, i int, barType BarType) float64 {
-	arr := candleData.Indicators[indicatorType][n][barType]
-	if len(arr) > i {
-		return arr[i]
+// calculateObv is a windowed variant of the on balance volume: the signed volumes of the last n candles,
+// not the standard obv summed from the first candle, so it does not depend on the history depth.
+// It is zero or negative when the window is falling
+func (candleData *CandleData) calculateObv(n, i int, barType BarType) float64 {
+	if i == 0 {
+		return 0
 	}
-
-	for k := len(arr); k <= i; k++ {
-		arr = append(arr, fun(n, k, barType))
-		candleData.Indicators[indicatorType][n][barType] = arr
+	obv := candleData.getObv(n, i-1, barType) + candleData.signedVolume(i, barType)
+	if i >= n {
+		obv -= candleData.signedVolume(i-n, barType)
 	}
+	return obv
+}
 
-	return arr[i]
+// signedVolume is the volume with the sign of the price move from the previous candle
+func (candleData *CandleData) signedVolume(i int, barType BarType) float64 {
+	prices := candleData.Candles[barType]
+	switch {
+	case i == 0 || prices[i] == prices[i-1]:
+		return 0
+	case prices[i] > prices[i-1]:
+		return candleData.Candles[V][i]
+	}
+	return -candleData.Candles[V][i]
+}
+
+func (candleData *CandleData) calculate(indicatorType IndicatorType, n, i int, barType BarType) float64 {
+	switch indicatorType {
+	case IndicatorTypeSma:
+		return candleData.calculateSma(n, i, barType)
+	case IndicatorTypeDema:
+		return candleData.calculateDema(n, i, barType)
+	case IndicatorTypeTema:
+		return candleData.calculateTema(n, i, barType)
+	case IndicatorTypeTemaZero:
+		return candleData.calculateTemaZero(n, i, barType)
+	case IndicatorType2Tema:
+		return candleData.calculate2Tema(n, i, barType)
+	case IndicatorTypeVwap:
+		return candleData.calculateVwap(n, i, barType)
+	case IndicatorTypeObv:
+		return candleData.calculateObv(n, i, barType)
+	case IndicatorTypeVolumeSma:
+		// the volume does not depend on the bar type
+		return candleData.getSma(n, i, V)
+	}
+	return candleData.calculateEma(indicatorType, n, i, barType)
 }
 
-func (candleData *CandleData) ema(indicatorType IndicatorType, fun funEma, source, prev funGet, n, i int, barType BarType) float64 {
-	arr := candleData.Indicators[indicatorType][n][barType]
-	if len(arr) > i {
-		return arr[i]
+// value is the indicator at i, the series is calculated up to i when it is shorter
+func (candleData *CandleData) value(indicatorType IndicatorType, n, i int, barType BarType) float64 {
+	if indicatorType == indicatorTypeCandle {
+		return candleData.Candles[barType][i]
 	}
 
-	for k := len(arr); k <= i; k++ {
-		arr = append(arr, fun(source, prev, n, k, barType))
-		candleData.Indicators[indicatorType][n][barType] = arr
+	values := candleData.series(indicatorType, n, barType)
+	if len(values) > i {
+		return values[i]
+	}
+	if values == nil {
+		values = make([]float64, 0, candleData.len()+indicatorReserve)
 	}
 
-	return arr[i]
+	for k := len(values); k <= i; k++ {
+		values = append(values, candleData.calculate(indicatorType, n, k, barType))
+		candleData.setSeries(indicatorType, n, barType, values)
+	}
+
+	return values[i]
 }
 
 func (candleData *CandleData) getSma(n, i int, barType BarType) float64 {
-	return candleData.get(IndicatorTypeSma, candleData.calculateSma, n, i, barType)
+	return candleData.value(IndicatorTypeSma, n, i, barType)
 }
 
 func (candleData *CandleData) getEma(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorTypeEma, candleData.calculateEma, candleData.getCandle, candleData.getEma, n, i, barType)
+	return candleData.value(IndicatorTypeEma, n, i, barType)
 }
 
 func (candleData *CandleData) get2Ema(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorType2Ema, candleData.calculateEma, candleData.getEma, candleData.get2Ema, n, i, barType)
+	return candleData.value(IndicatorType2Ema, n, i, barType)
 }
 
 func (candleData *CandleData) get3Ema(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorType3Ema, candleData.calculateEma, candleData.get2Ema, candleData.get3Ema, n, i, barType)
+	return candleData.value(IndicatorType3Ema, n, i, barType)
 }
 
 func (candleData *CandleData) getDema(n, i int, barType BarType) float64 {
-	return candleData.get(IndicatorTypeDema, candleData.calculateDema, n, i, barType)
+	return candleData.value(IndicatorTypeDema, n, i, barType)
 }
 
 func (candleData *CandleData) getTema(n, i int, barType BarType) float64 {
-	return candleData.get(IndicatorTypeTema, candleData.calculateTema, n, i, barType)
+	return candleData.value(IndicatorTypeTema, n, i, barType)
 }
 
 func (candleData *CandleData) getEmaTema(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorTypeEmaTema, candleData.calculateEma, candleData.getTema, candleData.getEmaTema, n, i, barType)
+	return candleData.value(IndicatorTypeEmaTema, n, i, barType)
 }
 
 func (candleData *CandleData) get2EmaTema(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorType2EmaTema, candleData.calculateEma, candleData.getEmaTema, candleData.get2EmaTema, n, i, barType)
+	return candleData.value(IndicatorType2EmaTema, n, i, barType)
 }
 
 func (candleData *CandleData) get3EmaTema(n, i int, barType BarType) float64 {
-	return candleData.ema(IndicatorType3EmaTema, candleData.calculateEma, candleData.get2EmaTema, candleData.get3EmaTema, n, i, barType)
+	return candleData.value(IndicatorType3EmaTema, n, i, barType)
 }
 
 func (candleData *CandleData) get2Tema(n, i int, barType BarType) float64 {
-	return candleData.get(IndicatorType2Tema, candleData.calculate2Tema, n, i, barType)
+	return candleData.value(IndicatorType2Tema, n, i, barType)
 }
 
 func (candleData *CandleData) getTemaZero(n, i int, barType BarType) float64 {
-	return candleData.get(IndicatorTypeTemaZero, candleData.calculateTemaZero, n, i, barType)
+	return candleData.value(IndicatorTypeTemaZero, n, i, barType)
 }
 
+func (candleData *CandleData) getObv(n, i int, barType BarType) float64 {
+	return candleData.value(IndicatorTypeObv, n, i, barType)
+}
+
+func (candleData *CandleData) getVolumeSma(n, i int) float64 {
+	return candleData.value(IndicatorTypeVolumeSma, n, i, V)
+}
+
+// fillIndicators warms the cache of the search periods, the series is empty when its download failed
 func (candleData *CandleData) fillIndicators() {
 	l := candleData.index()
-
-	for _, indicatorType := range IndicatorTypes {
-		candleData.Indicators[indicatorType] = make(map[int]map[BarType][]float64)
+	if l < 0 {
+		return
 	}
+	candleData.invalidate(0)
 
 	for n := 3; n <= 70; n++ {
-		fmt.Println(n)
-		for _, indicatorType := range IndicatorTypes {
-			candleData.Indicators[indicatorType][n] = make(map[BarType][]float64)
-		}
-
 		for _, barType := range BarTypes {
 			candleData.getSma(n, l, barType)
 			candleData.getEma(n, l, barType)
@@ -377,13 +718,110 @@ func (strategyType StrategyType) value(s string) StrategyType {
 }
 
 type Strategy struct {
-	Pair string
-	Op   int
-	Ind1 Indicator
-	Tp   int
-	Ind2 Indicator
-	Sl   int
-	Type StrategyType
+	Exchange   string // the candles source, set by the account
+	Pair       string
+	Resolution Resolution
+	Op         int
+	Ind1       Indicator
+	Tp         int
+	Ind2       Indicator
+	Sl         int
+	Type       StrategyType
+	Entry      Entry
+	Trailing   Trailing
+	Volume     VolumeFilter
+}
+
+type EntryType int8
+
+const (
+	EntryMarket EntryType = iota
+	EntryBid
+	EntryOpen
+)
+
+func (entryType EntryType) String() string {
+	return map[EntryType]string{
+		EntryMarket: "market",
+		EntryBid:    "bid",
+		EntryOpen:   "open",
+	}[entryType]
+}
+
+func (entryType EntryType) value(s string) EntryType {
+	return map[string]EntryType{
+		"market": EntryMarket,
+		"bid":    EntryBid,
+		"open":   EntryOpen,
+	}[s]
+}
+
+// Entry describes how the position is opened: limit orders wait Timeout seconds,
+// then the rest is bought by market if Fallback is set. Offset is in 1/10000 of the price like Op and Tp
+type Entry struct {
+	Type     EntryType
+	Offset   int
+	Timeout  int
+	Fallback bool
+}
+
+func (entry Entry) String() string {
+	if entry.Type == EntryMarket {
+		return ""
+	}
+	fallback := "none"
+	if entry.Fallback {
+		fallback = "market"
+	}
+	return fmt.Sprintf(" | %s%+d %ds %s", entry.Type, entry.Offset, entry.Timeout, fallback)
+}
+
+type TrailingType int8
+
+const (
+	TrailingNone TrailingType = iota
+	TrailingPercent
+	TrailingAtr
+)
+
+// Trailing keeps the stop loss at Value percents or Value ATR of Period candles from the price.
+// The stop is moved only when it goes by Step (in 1/10000 of the price) or more
+type Trailing struct {
+	Type   TrailingType
+	Value  float64
+	Period int
+	Step   int
+}
+
+func (trailing Trailing) String() string {
+	switch trailing.Type {
+	case TrailingPercent:
+		return fmt.Sprintf(" | trail %s%% step %d", f2s(trailing.Value), trailing.Step)
+	case TrailingAtr:
+		return fmt.Sprintf(" | trail %s atr%d step %d", f2s(trailing.Value), trailing.Period, trailing.Step)
+	}
+	return ""
+}
+
+// VolumeFilter lets the strategy open only when the volume of the closed candle is Ratio times
+// its average of Period candles or more. Zero Ratio turns the filter off
+type VolumeFilter struct {
+	Ratio  float64
+	Period int
+}
+
+func (filter VolumeFilter) String() string {
+	if filter.Ratio == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" | volume %sx sma%d", f2s(filter.Ratio), filter.Period)
+}
+
+func (filter VolumeFilter) check(candleData *CandleData, i int) bool {
+	if filter.Ratio == 0 {
+		return true
+	}
+	return candleData.Candles[V][i] >= filter.Ratio*candleData.getVolumeSma(filter.Period, i)
 }
 
 type Indicator struct {
@@ -392,39 +830,95 @@ type Indicator struct {
 	Coef          int
 }
 
-func (strategy Strategy) getCandleData() *CandleData {
-	return getCandleData(strategy.Pair)
+// historyDepth is the number of candles the strategy needs: the chart and the longest period before it
+func (strategy Strategy) historyDepth() int {
+	periods := []int{strategy.Ind1.Coef, strategy.Ind2.Coef}
+	if strategy.Volume.Ratio > 0 {
+		periods = append(periods, strategy.Volume.Period)
+	}
+	if strategy.Trailing.Type == TrailingAtr {
+		periods = append(periods, strategy.Trailing.Period)
+	}
+	longest := 0
+	for _, period := range periods {
+		if period > longest {
+			longest = period
+		}
+	}
+	return chartCandles + longest
+}
+
+// updateCandles runs fn with the candles of the strategy locked
+func (strategy Strategy) updateCandles(fn func(candleData *CandleData)) {
+	CandleStorage.update(strategy.Exchange, strategy.Pair, strategy.Resolution, fn)
 }
 
-func (indicatorType IndicatorType) getFunction(data *CandleData) funGet {
-	return map[IndicatorType]funGet{
-		IndicatorTypeSma:      data.getSma,
-		IndicatorTypeEma:      data.getEma,
-		IndicatorTypeDema:     data.getDema,
-		IndicatorTypeTema:     data.getTema,
-		IndicatorTypeTemaZero: data.getTemaZero,
-		IndicatorType2Ema:     data.get2Ema,
-		IndicatorType3Ema:     data.get3Ema,
-		IndicatorTypeEmaTema:  data.getEmaTema,
-		IndicatorType2EmaTema: data.get2EmaTema,
-		IndicatorType3EmaTema: data.get3EmaTema,
-		IndicatorType2Tema:    data.get2Tema,
-	}[indicatorType]
+func (strategy Strategy) candlesSnapshot() *CandleData {
+	return CandleStorage.snapshot(strategy.Exchange, strategy.Pair, strategy.Resolution)
+}
+
+func (strategy Strategy) isShort() bool {
+	return strategy.Type == Short || strategy.Type == ShortSl
+}
+
+// percentsForOpen is above 1.0 when v1/v2 is above 1+Op for longs or below 1-Op for shorts.
+// The ratio has no sense for a value that is not positive, like the windowed obv, such strategy does not open
+func (strategy Strategy) percentsForOpen(v1, v2 float64) float64 {
+	if v1 <= 0 || v2 <= 0 {
+		return 0
+	}
+	if strategy.isShort() {
+		return float64(10000-strategy.Op) * v2 / v1 / 10000
+	}
+	return 10000 * v1 / v2 / float64(10000+strategy.Op)
+}
+
+// percentsToClose reaches 1.0 when the position earned Tp after fees,
+// netFactor is the part of the money left after the round trip fees
+func (strategy Strategy) percentsToClose(openedPrice, price, netFactor float64) float64 {
+	if strategy.isShort() {
+		return openedPrice * float64(10000-strategy.Tp) * netFactor / price / 10000
+	}
+	return price * netFactor * 10000 / openedPrice / float64(10000+strategy.Tp)
+}
+
+func (strategy Strategy) takeProfitPrice(openedPrice, netFactor float64) float64 {
+	if strategy.isShort() {
+		return openedPrice * float64(10000-strategy.Tp) * netFactor / 10000
+	}
+	return openedPrice * float64(10000+strategy.Tp) / netFactor / 10000
+}
+
+func (strategy Strategy) stopLossPrice(openedPrice float64) float64 {
+	if strategy.isShort() {
+		return openedPrice * 1.2
+	}
+	return openedPrice * 0.8
+}
+
+// closingSide is the order type that closes the position
+func (strategy Strategy) closingSide() string {
+	if strategy.isShort() {
+		return "buy"
+	}
+	return "sell"
 }
 
 func (indicator Indicator) getValue(data *CandleData, i int) float64 {
-	return indicator.IndicatorType.getFunction(data)(indicator.Coef, i, indicator.BarType)
+	return data.value(indicator.IndicatorType, indicator.Coef, i, indicator.BarType)
 }
 
 func (strategy Strategy) String() string {
-	return fmt.Sprintf("{ %s %s %s %s %s | %s | %s }",
+	return fmt.Sprintf("{ %s %s %s %s %s %s | %s | %s%s }",
 		color.New(color.FgBlue).Sprintf("%s", strategy.Pair),
+		color.New(color.FgHiWhite).Sprintf("%s", strategy.Resolution),
 		color.New(color.BgYellow, color.FgBlack).Sprintf("%s", strategy.Type),
 		color.New(color.BgHiBlue, color.FgBlack).Sprintf("%3d", strategy.Op),
 		color.New(color.BgHiGreen, color.FgBlack).Sprintf("%3d", strategy.Tp),
 		color.New(color.BgHiRed, color.FgBlack).Sprintf("%4d", strategy.Sl),
 		strategy.Ind1.String(),
 		strategy.Ind2.String(),
+		strategy.Entry.String()+strategy.Trailing.String()+strategy.Volume.String(),
 	)
 }
 
@@ -437,9 +931,9 @@ func (indicator Indicator) String() string {
 }
 
 func (candleData *CandleData) getIndicatorValue(indicator Indicator) []float64 {
-	return candleData.Indicators[indicator.IndicatorType][indicator.Coef][indicator.BarType]
+	return candleData.series(indicator.IndicatorType, indicator.Coef, indicator.BarType)
 }
 
 func (candleData *CandleData) getIndicatorRatio(strategy Strategy, index int) float64 {
-	return candleData.getIndicatorValue(strategy.Ind1)[index] / candleData.getIndicatorValue(strategy.Ind2)[index]
+	return strategy.Ind1.getValue(candleData, index) / strategy.Ind2.getValue(candleData, index)
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"sort"
+	"time"
+)
+
+// fillCandleGaps repeats the last close in the candles the exchange does not have, "candles.gaps=fill" in the env.
+// By default such gaps are only marked and the series skips them
+var fillCandleGaps bool
+
+// Gap is a range of missing candles, From and To are the first and the last of them
+type Gap struct {
+	From   time.Time
+	To     time.Time
+	Filled bool
+}
+
+func (gap Gap) count(resolution Resolution) int {
+	return int(gap.To.Sub(gap.From)/resolution.duration()) + 1
+}
+
+// findGaps compares the neighbour candles with the resolution, marked gaps are known already
+func (candleData *CandleData) findGaps() []Gap {
+	var gaps []Gap
+	step := candleData.Resolution.duration()
+	for i := 1; i < candleData.len(); i++ {
+		expected := candleData.Time[i-1].Add(step)
+		if !candleData.Time[i].After(expected) {
+			continue
+		}
+		gap := Gap{From: expected, To: candleData.Time[i].Add(-step)}
+		if !candleData.isMarked(gap) {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps
+}
+
+func (candleData *CandleData) isMarked(gap Gap) bool {
+	for _, marked := range candleData.Gaps {
+		if marked.From.Equal(gap.From) && marked.To.Equal(gap.To) {
+			return true
+		}
+	}
+	return false
+}
+
+// fillGaps requests every gap again, what stays missing is marked or forward filled.
+// Returns true when candles were put inside the series
+func (candleData *CandleData) fillGaps(download func(from, to time.Time) []Candle) bool {
+	changed := false
+	for _, gap := range candleData.findGaps() {
+		for _, candle := range download(gap.From, gap.To) {
+			if !candle.T.Before(gap.From) && !candle.T.After(gap.To) && candleData.insertCandle(candle) {
+				changed = true
+			}
+		}
+	}
+
+	for _, gap := range candleData.findGaps() {
+		color.HiYellow("%s", candleData.gapReport(gap, fillCandleGaps))
+		if fillCandleGaps {
+			candleData.forwardFill(gap)
+			gap.Filled = true
+			changed = true
+		}
+		candleData.Gaps = append(candleData.Gaps, gap)
+	}
+
+	return changed
+}
+
+func (candleData *CandleData) gapReport(gap Gap, filled bool) string {
+	return fmt.Sprintf("GAP %s %s %s - %s missing:%d filled:%t",
+		candleData.Pair, candleData.Resolution,
+		gap.From.Format("02.01.06 15:04"), gap.To.Format("02.01.06 15:04"),
+		gap.count(candleData.Resolution), filled,
+	)
+}
+
+// forwardFill puts flat candles without volume at the close of the candle before the gap
+func (candleData *CandleData) forwardFill(gap Gap) {
+	i := sort.Search(candleData.len(), func(i int) bool {
+		return !candleData.Time[i].Before(gap.From)
+	})
+	if i == 0 {
+		return
+	}
+	price := candleData.Candles[C][i-1]
+	for t := gap.From; !t.After(gap.To); t = t.Add(candleData.Resolution.duration()) {
+		candleData.insertCandle(newCandle(price, price, price, price, 0, t))
+	}
+}
+
+// insertCandle puts the candle inside the series, indicators after it are calculated again
+func (candleData *CandleData) insertCandle(c Candle) bool {
+	i := sort.Search(candleData.len(), func(i int) bool {
+		return !candleData.Time[i].Before(c.T)
+	})
+	if i < candleData.len() && candleData.Time[i].Equal(c.T) {
+		return false
+	}
+
+	candleData.Time = append(candleData.Time[:i], append([]time.Time{c.T}, candleData.Time[i:]...)...)
+	for _, barType := range BarTypes {
+		values := candleData.Candles[barType]
+		candleData.Candles[barType] = append(values[:i], append([]float64{c.getPrice(barType)}, values[i:]...)...)
+	}
+	candleData.invalidate(i)
+	return true
+}
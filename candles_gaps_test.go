@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withoutCandles is the series with the given candles missing
+func withoutCandles(candles []Candle, missing ...int) []Candle {
+	var series []Candle
+	for i, candle := range candles {
+		skip := false
+		for _, m := range missing {
+			skip = skip || i == m
+		}
+		if !skip {
+			series = append(series, candle)
+		}
+	}
+	return series
+}
+
+// downloadFrom serves the candles of the range like the exchange, with one neighbour on each side
+func downloadFrom(candles []Candle, calls *int) func(from, to time.Time) []Candle {
+	return func(from, to time.Time) []Candle {
+		*calls++
+		var found []Candle
+		for _, candle := range candles {
+			if !candle.T.Before(from.Add(-time.Hour)) && !candle.T.After(to.Add(time.Hour)) {
+				found = append(found, candle)
+			}
+		}
+		return found
+	}
+}
+
+func setFillCandleGaps(t *testing.T, fill bool) {
+	saved := fillCandleGaps
+	fillCandleGaps = fill
+	t.Cleanup(func() { fillCandleGaps = saved })
+}
+
+func assertGaps(t *testing.T, gaps []Gap, expected ...Gap) {
+	t.Helper()
+	if len(gaps) != len(expected) {
+		t.Fatalf("gaps %v, expected %v", gaps, expected)
+	}
+	for i, gap := range gaps {
+		if !gap.From.Equal(expected[i].From) || !gap.To.Equal(expected[i].To) || gap.Filled != expected[i].Filled {
+			t.Errorf("gap %d is %v, expected %v", i, gap, expected[i])
+		}
+	}
+}
+
+// TestFindGaps: the neighbour candles are compared with the resolution of the series
+func TestFindGaps(t *testing.T) {
+	candles := testCandleSeries(100)
+	candleData := newTestCandleData(withoutCandles(candles, 20, 21, 22, 50))
+	assertGaps(t, candleData.findGaps(),
+		Gap{From: candles[20].T, To: candles[22].T},
+		Gap{From: candles[50].T, To: candles[50].T},
+	)
+
+	candleData.Gaps = []Gap{{From: candles[20].T, To: candles[22].T}}
+	assertGaps(t, candleData.findGaps(), Gap{From: candles[50].T, To: candles[50].T})
+
+	// часовые свечи в 15 минутной серии пропускают по три
+	quarters := initCandleData("exmo", "ETC_USDT", "15")
+	for _, candle := range candles[:3] {
+		quarters.upsertCandle(candle)
+	}
+	assertGaps(t, quarters.findGaps(),
+		Gap{From: candles[0].T.Add(15 * time.Minute), To: candles[0].T.Add(45 * time.Minute)},
+		Gap{From: candles[1].T.Add(15 * time.Minute), To: candles[1].T.Add(45 * time.Minute)},
+	)
+	if count := quarters.findGaps()[0].count(quarters.Resolution); count != 3 {
+		t.Errorf("missing %d quarters, expected 3", count)
+	}
+
+	// в 4 часовой серии те же свечи идут через одну
+	fourHours := initCandleData("exmo", "ETC_USDT", "240")
+	for i := 0; i < len(candles); i += 4 {
+		fourHours.upsertCandle(candles[i])
+	}
+	assertGaps(t, fourHours.findGaps())
+}
+
+// TestFillGapsBackfill: the downloaded candles are put in the middle, the cached indicators after them are calculated again
+func TestFillGapsBackfill(t *testing.T) {
+	setFillCandleGaps(t, false)
+	candles := testCandleSeries(200)
+	candleData := newTestCandleData(withoutCandles(candles, 80, 81, 82, 150))
+	warmIndicators(candleData)
+
+	calls := 0
+	if !candleData.fillGaps(downloadFrom(candles, &calls)) {
+		t.Fatal("the downloaded candles are not reported")
+	}
+	if calls != 2 {
+		t.Errorf("downloads %d, expected 2", calls)
+	}
+	assertGaps(t, candleData.Gaps)
+	assertColdRecompute(t, candleData, candles)
+}
+
+// TestFillGapsMarked: by default what the exchange does not have is only marked and not requested again
+func TestFillGapsMarked(t *testing.T) {
+	setFillCandleGaps(t, false)
+	candles := testCandleSeries(200)
+	series := withoutCandles(candles, 80, 81, 82)
+	candleData := newTestCandleData(series)
+	warmIndicators(candleData)
+
+	calls := 0
+	if candleData.fillGaps(downloadFrom(nil, &calls)) {
+		t.Error("the series is reported as changed")
+	}
+	assertGaps(t, candleData.Gaps, Gap{From: candles[80].T, To: candles[82].T})
+	assertColdRecompute(t, candleData, series)
+
+	if candleData.fillGaps(downloadFrom(nil, &calls)) || calls != 1 {
+		t.Errorf("the marked gap is requested again, downloads %d", calls)
+	}
+	assertGaps(t, candleData.Gaps, Gap{From: candles[80].T, To: candles[82].T})
+}
+
+// TestFillGapsForwardFill: "candles.gaps=fill" puts flat candles at the previous close, the downloaded ones are kept
+func TestFillGapsForwardFill(t *testing.T) {
+	setFillCandleGaps(t, true)
+	candles := testCandleSeries(200)
+	candleData := newTestCandleData(withoutCandles(candles, 80, 81, 82))
+	warmIndicators(candleData)
+
+	calls := 0
+	if !candleData.fillGaps(downloadFrom(withoutCandles(candles, 80, 82), &calls)) {
+		t.Fatal("the filled candles are not reported")
+	}
+	assertGaps(t, candleData.Gaps,
+		Gap{From: candles[80].T, To: candles[80].T, Filled: true},
+		Gap{From: candles[82].T, To: candles[82].T, Filled: true},
+	)
+
+	expected := append([]Candle{}, candles...)
+	for _, i := range []int{80, 82} {
+		price := candles[i-1].C
+		expected[i] = newCandle(price, price, price, price, 0, candles[i].T)
+	}
+	assertColdRecompute(t, candleData, expected)
+	if v := candleData.Candles[V][80]; v != 0 {
+		t.Errorf("filled candle volume %v", v)
+	}
+
+	if candleData.fillGaps(downloadFrom(candles, &calls)) || calls != 1 {
+		t.Errorf("the filled gaps are requested again, downloads %d", calls)
+	}
+}
+
+func TestGapReport(t *testing.T) {
+	candles := testCandleSeries(100)
+	candleData := newTestCandleData(candles)
+	gap := Gap{From: candles[20].T, To: candles[22].T}
+
+	if report := candleData.gapReport(gap, false); report != "GAP ETC_USDT 60 01.01.22 20:00 - 01.01.22 22:00 missing:3 filled:false" {
+		t.Errorf("report %q", report)
+	}
+	candleData.Resolution = "15"
+	if report := candleData.gapReport(gap, true); report != "GAP ETC_USDT 15 01.01.22 20:00 - 01.01.22 22:00 missing:9 filled:true" {
+		t.Errorf("report %q", report)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "sync"
+
+// CandleRepository keeps the candles of all accounts. Every series has its own lock, so the jobs, the streams
+// and the engines of different pairs do not wait for each other, and the ones of the same pair take turns
+type CandleRepository struct {
+	mutex  sync.RWMutex
+	series map[string]*candleSeries
+}
+
+type candleSeries struct {
+	mutex sync.Mutex
+	data  *CandleData
+}
+
+// CandleStorage is keyed by candleKey, one pair may be traded with several resolutions
+var CandleStorage *CandleRepository
+
+func newCandleRepository() *CandleRepository {
+	return &CandleRepository{series: make(map[string]*candleSeries)}
+}
+
+// get returns the series of the key, an empty one is created on the first use
+func (repository *CandleRepository) get(exchange, pair string, resolution Resolution) *candleSeries {
+	key := candleKey(exchange, pair, resolution)
+
+	repository.mutex.RLock()
+	series, ok := repository.series[key]
+	repository.mutex.RUnlock()
+	if ok {
+		return series
+	}
+
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+	if series, ok = repository.series[key]; !ok {
+		series = &candleSeries{data: initCandleData(exchange, pair, resolution)}
+		repository.series[key] = series
+	}
+	return series
+}
+
+// update runs fn with the series locked, the candles are changed in place.
+// Indicators are cached on the first read, so reading them is an update too
+func (repository *CandleRepository) update(exchange, pair string, resolution Resolution, fn func(candleData *CandleData)) {
+	series := repository.get(exchange, pair, resolution)
+	series.mutex.Lock()
+	defer series.mutex.Unlock()
+
+	fn(series.data)
+}
+
+// snapshot is a copy of the candles for the readers outside the lock, the charts are drawn from it
+func (repository *CandleRepository) snapshot(exchange, pair string, resolution Resolution) *CandleData {
+	var snapshot *CandleData
+	repository.update(exchange, pair, resolution, func(candleData *CandleData) {
+		snapshot = candleData.clone()
+	})
+	return snapshot
+}
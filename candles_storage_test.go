@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// appendNextCandle is a read-modify-write of the series, a lost update shortens it
+func appendNextCandle(candleData *CandleData) {
+	t := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	if candleData.len() > 0 {
+		t = candleData.lastTime().Add(time.Hour)
+	}
+	price := 20 + float64(candleData.len()%7)
+	candleData.upsertCandle(newCandle(price-1, price, price+0.5, price+1, 100, t))
+	candleData.getTema(14, candleData.index(), C)
+}
+
+// checkSnapshot reads the copy outside the lock, every bar type has a value for every time
+func checkSnapshot(t *testing.T, snapshot *CandleData) {
+	for _, barType := range BarTypes {
+		if len(snapshot.Candles[barType]) != snapshot.len() {
+			t.Errorf("%s %s candles %d, times %d", snapshot.Pair, barType, len(snapshot.Candles[barType]), snapshot.len())
+			return
+		}
+	}
+	if i := snapshot.index(); i >= 0 {
+		snapshot.getTema(14, i, C)
+		snapshot.Candles[C][i] = 0
+	}
+}
+
+// runStorageWorkers starts writers and readers of every pair at once and waits for them
+func runStorageWorkers(t *testing.T, repository *CandleRepository, pairs []string, workers, updates int) {
+	var wg sync.WaitGroup
+	for _, pair := range pairs {
+		for w := 0; w < workers; w++ {
+			wg.Add(2)
+			go func(pair string) {
+				defer wg.Done()
+				for i := 0; i < updates; i++ {
+					repository.update("exmo", pair, defaultResolution, appendNextCandle)
+				}
+			}(pair)
+			go func(pair string) {
+				defer wg.Done()
+				for i := 0; i < updates; i++ {
+					checkSnapshot(t, repository.snapshot("exmo", pair, defaultResolution))
+				}
+			}(pair)
+		}
+	}
+	wg.Wait()
+}
+
+// TestCandleStorageSameKey: the writers of one series take turns, no update is lost
+func TestCandleStorageSameKey(t *testing.T) {
+	repository := newCandleRepository()
+	runStorageWorkers(t, repository, []string{"ETC_USDT"}, 8, 50)
+
+	snapshot := repository.snapshot("exmo", "ETC_USDT", defaultResolution)
+	if snapshot.len() != 8*50 {
+		t.Errorf("candles %d, expected %d", snapshot.len(), 8*50)
+	}
+	if snapshot.Candles[C][snapshot.index()] == 0 {
+		t.Error("the snapshot is shared with the reader that changed it")
+	}
+}
+
+// TestCandleStorageDifferentKeys: the series are created concurrently and do not mix
+func TestCandleStorageDifferentKeys(t *testing.T) {
+	repository := newCandleRepository()
+	pairs := []string{"ETC_USDT", "BTC_USDT", "ETH_USDT", "XRP_USDT"}
+	runStorageWorkers(t, repository, pairs, 4, 50)
+
+	for _, pair := range pairs {
+		snapshot := repository.snapshot("exmo", pair, defaultResolution)
+		if snapshot.Pair != pair || snapshot.len() != 4*50 {
+			t.Errorf("%s series of %s has %d candles, expected %d", pair, snapshot.Pair, snapshot.len(), 4*50)
+		}
+	}
+	if len(repository.series) != len(pairs) {
+		t.Errorf("series %d, expected %d", len(repository.series), len(pairs))
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPeriods are short, medium and long, the long one is longer than the revised tail.
+// The last one is above maxIndicatorCoef and cached in the map
+var testPeriods = []int{3, 14, 50, 150}
+
+// testCandleSeries are hourly candles with moving prices and volumes, the same on every call
+func testCandleSeries(count int) []Candle {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	candles := make([]Candle, count)
+	for i := range candles {
+		o := 20 + 3*math.Sin(float64(i)/7)
+		c := 20 + 3*math.Sin(float64(i+1)/7)
+		h := math.Max(o, c) + 0.5 + 0.3*math.Cos(float64(i))
+		l := math.Min(o, c) - 0.5 - 0.2*math.Sin(float64(i))
+		v := 100 + 50*math.Abs(math.Sin(float64(i)/3))
+		candles[i] = newCandle(l, o, c, h, v, start.Add(time.Duration(i)*time.Hour))
+	}
+	return candles
+}
+
+func newTestCandleData(candles []Candle) *CandleData {
+	candleData := initCandleData("exmo", "ETC_USDT", defaultResolution)
+	for _, candle := range candles {
+		candleData.upsertCandle(candle)
+	}
+	return candleData
+}
+
+// warmIndicators caches every indicator of the test periods up to the last candle
+func warmIndicators(candleData *CandleData) {
+	for _, indicatorType := range IndicatorTypes {
+		for _, n := range testPeriods {
+			for _, barType := range BarTypes {
+				candleData.value(indicatorType, n, candleData.index(), barType)
+			}
+		}
+	}
+}
+
+// assertColdRecompute compares every cached value with the candles calculated from scratch
+func assertColdRecompute(t *testing.T, warm *CandleData, candles []Candle) {
+	t.Helper()
+	cold := newTestCandleData(candles)
+	if warm.len() != cold.len() {
+		t.Fatalf("candles %d, expected %d", warm.len(), cold.len())
+	}
+	for i := range cold.Time {
+		if !warm.Time[i].Equal(cold.Time[i]) {
+			t.Fatalf("time %d is %s, expected %s", i, warm.Time[i], cold.Time[i])
+		}
+	}
+
+	mismatches := 0
+	for _, indicatorType := range IndicatorTypes {
+		for _, n := range testPeriods {
+			for _, barType := range BarTypes {
+				for i := 0; i < cold.len() && mismatches < 10; i++ {
+					got := warm.value(indicatorType, n, i, barType)
+					expected := cold.value(indicatorType, n, i, barType)
+					if got != expected {
+						t.Errorf("%d(%d) %s at %d: %v, cold %v", indicatorType, n, barType, i, got, expected)
+						mismatches++
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestUpsertRevisedLastCandle: the last candle is changed by the history download after the stream
+func TestUpsertRevisedLastCandle(t *testing.T) {
+	candles := testCandleSeries(200)
+	candleData := newTestCandleData(candles)
+	warmIndicators(candleData)
+
+	last := candles[len(candles)-1]
+	candles[len(candles)-1] = newCandle(last.L-1, last.O, last.C+2, last.H+2, last.V*3, last.T)
+	if candleData.upsertCandle(candles[len(candles)-1]) {
+		t.Fatal("the revised candle is appended")
+	}
+	assertColdRecompute(t, candleData, candles)
+}
+
+// TestUpsertRevisedPreviousCandle: the closed candle is revised while the live one already follows it
+func TestUpsertRevisedPreviousCandle(t *testing.T) {
+	candles := testCandleSeries(200)
+	candleData := newTestCandleData(candles)
+	warmIndicators(candleData)
+
+	for revision := 1; revision <= 3; revision++ {
+		previous := candles[len(candles)-2]
+		candles[len(candles)-2] = newCandle(previous.L, previous.O, previous.C-float64(revision)*0.1, previous.H,
+			previous.V+float64(revision), previous.T)
+		candleData.upsertCandle(candles[len(candles)-2])
+		assertColdRecompute(t, candleData, candles)
+	}
+}
+
+// TestUpsertUnchangedCandle keeps the cache, the stream repeats the same candle every trade
+func TestUpsertUnchangedCandle(t *testing.T) {
+	candles := testCandleSeries(100)
+	candleData := newTestCandleData(candles)
+	warmIndicators(candleData)
+
+	candleData.upsertCandle(candles[len(candles)-1])
+	key := indicatorKey(IndicatorTypeTema, 14, C)
+	if cached := len(candleData.Indicators[key]); cached != len(candles) {
+		t.Errorf("cached %d of %d values", cached, len(candles))
+	}
+	assertColdRecompute(t, candleData, candles)
+}
+
+// TestUpsertAppendedCandle: the new candle is calculated from the cached values
+func TestUpsertAppendedCandle(t *testing.T) {
+	candles := testCandleSeries(150)
+	candleData := newTestCandleData(candles[:149])
+	warmIndicators(candleData)
+
+	if !candleData.upsertCandle(candles[149]) {
+		t.Fatal("the new candle is not appended")
+	}
+	if candleData.upsertCandle(candles[100]) {
+		t.Fatal("the old candle is appended")
+	}
+	assertColdRecompute(t, candleData, candles)
+}
+
+// TestInsertCandleInTheMiddle: the gap is filled after the indicators were cached
+func TestInsertCandleInTheMiddle(t *testing.T) {
+	candles := testCandleSeries(200)
+	var withGap []Candle
+	withGap = append(withGap, candles[:80]...)
+	withGap = append(withGap, candles[83:]...)
+	candleData := newTestCandleData(withGap)
+	warmIndicators(candleData)
+
+	for _, i := range []int{81, 80, 82} {
+		if !candleData.insertCandle(candles[i]) {
+			t.Fatalf("candle %d is not inserted", i)
+		}
+	}
+	if candleData.insertCandle(candles[81]) {
+		t.Fatal("the existing candle is inserted again")
+	}
+	assertColdRecompute(t, candleData, candles)
+}
+
+// TestTrimCandles: indexes move, the cache is calculated again from the new first candle
+func TestTrimCandles(t *testing.T) {
+	candles := testCandleSeries(200)
+	candleData := newTestCandleData(candles)
+	warmIndicators(candleData)
+
+	candleData.trim(candles[60].T)
+	assertColdRecompute(t, candleData, candles[60:])
+}
+
+// TestDrawBarsShortHistory: a young pair has fewer candles than the chart, it is drawn as is
+func TestDrawBarsShortHistory(t *testing.T) {
+	inTempDir(t)
+	for _, count := range []int{0, 1, 10, chartCandles} {
+		candleData := newTestCandleData(testCandleSeries(count))
+		if path := candleData.drawBars(24, 16); path == "" {
+			t.Errorf("no chart of %d candles", count)
+		}
+	}
+}
+
+// TestStrategyHistoryDepth: the history has the chart and the longest period of the indicators, the volume and the atr
+func TestStrategyHistoryDepth(t *testing.T) {
+	for str, depth := range map[string]int{
+		"ETC_USDT long 100 200 2000 | 1 C 1 | 1 C 10":                              chartCandles + 10,
+		"ETC_USDT long 100 200 2000 | 1 C 30 | 1 C 10 volume=2 volsma=40":          chartCandles + 40,
+		"ETC_USDT long 100 200 2000 | 1 C 30 | 1 C 10 volsma=40":                   chartCandles + 30,
+		"ETC_USDT short 100 200 2000 | 1 C 30 | 1 C 10 trail=2atr atr=50":          chartCandles + 50,
+		"ETC_USDT short 100 200 2000 | 1 C 30 | 1 C 10 trail=2% atr=50 volume=1.5": chartCandles + 30,
+	} {
+		if got := getStrategy(str).historyDepth(); got != depth {
+			t.Errorf("%s: depth %d, expected %d", str, got, depth)
+		}
+	}
+}
+
+// TestStrategyLongPeriod: periods above the flat table, like sma 200, are parsed and calculated
+func TestStrategyLongPeriod(t *testing.T) {
+	strategy := getStrategy("ETC_USDT long 100 200 2000 | 1 C 200 | 1 C 10 volume=1.5 volsma=120")
+	if strategy.Ind1.Coef != 200 || strategy.Volume.Period != 120 {
+		t.Fatalf("periods %d and %d, expected 200 and 120", strategy.Ind1.Coef, strategy.Volume.Period)
+	}
+
+	candles := testCandleSeries(300)
+	candleData := newTestCandleData(candles)
+	i := candleData.index()
+	sma, volume := 0.0, 0.0
+	for _, candle := range candles[i-199:] {
+		sma += candle.C
+	}
+	for _, candle := range candles[i-119:] {
+		volume += candle.V
+	}
+	if got := strategy.Ind1.getValue(candleData, i); math.Abs(got-sma/200) > 1e-9 {
+		t.Errorf("sma200 %v, expected %v", got, sma/200)
+	}
+	if got := candleData.getVolumeSma(120, i); math.Abs(got-volume/120) > 1e-9 {
+		t.Errorf("volume sma120 %v, expected %v", got, volume/120)
+	}
+	if cached := len(candleData.getIndicatorValue(strategy.Ind1)); cached != len(candles) {
+		t.Errorf("cached %d of %d values", cached, len(candles))
+	}
+}
+
+// volumeCandles are flat candles at the closes 10 11 11 9 12 with the volumes 100 200 300 400 500
+func volumeCandles() *CandleData {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var candles []Candle
+	for i, c := range []float64{10, 11, 11, 9, 12} {
+		candles = append(candles, newCandle(c, c, c, c, float64(100*(i+1)), start.Add(time.Duration(i)*time.Hour)))
+	}
+	return newTestCandleData(candles)
+}
+
+// TestVolumeIndicators: the values are calculated by hand from the volume candles
+func TestVolumeIndicators(t *testing.T) {
+	for _, test := range []struct {
+		indicatorType IndicatorType
+		n             int
+		expected      []float64
+	}{
+		// (10*100 + 11*200) / 300, ..., (11*300 + 9*400 + 12*500) / 1200
+		{IndicatorTypeVwap, 3, []float64{10, 3200.0 / 300, 6500.0 / 600, 9100.0 / 900, 12900.0 / 1200}},
+		{IndicatorTypeVwap, 1, []float64{10, 11, 11, 9, 12}},
+		// signed volumes 0 +200 0 -400 +500 summed over the last 3
+		{IndicatorTypeObv, 3, []float64{0, 200, 200, -200, 100}},
+		{IndicatorTypeObv, 10, []float64{0, 200, 200, -200, 300}},
+		{IndicatorTypeVolumeSma, 2, []float64{100, 150, 250, 350, 450}},
+		{IndicatorTypeVolumeSma, 3, []float64{100, 150, 200, 300, 400}},
+	} {
+		candleData := volumeCandles()
+		// the cache is read backwards to calculate the whole series at once
+		for i := candleData.index(); i >= 0; i-- {
+			if got := candleData.value(test.indicatorType, test.n, i, C); math.Abs(got-test.expected[i]) > 1e-9 {
+				t.Errorf("%d(%d) at %d: %v, expected %v", test.indicatorType, test.n, i, got, test.expected[i])
+			}
+		}
+	}
+
+	candleData := volumeCandles()
+	for i := range candleData.Candles[V] {
+		candleData.Candles[V][i] = 0
+	}
+	if vwap := candleData.value(IndicatorTypeVwap, 3, 3, C); vwap != 9 {
+		t.Errorf("vwap without volume %v, expected the price 9", vwap)
+	}
+}
+
+// TestVolumeFilter: the last volume 500 is compared with the average 400 of 3 candles
+func TestVolumeFilter(t *testing.T) {
+	candleData := volumeCandles()
+	for filter, expected := range map[VolumeFilter]bool{
+		{}:                      true,
+		{Ratio: 1.2, Period: 3}: true,
+		{Ratio: 1.3, Period: 3}: false,
+		{Ratio: 1, Period: 2}:   true,
+		{Ratio: 1.2, Period: 2}: false,
+	} {
+		if got := filter.check(candleData, candleData.index()); got != expected {
+			t.Errorf("%+v: %t, expected %t", filter, got, expected)
+		}
+	}
+}
+
+// TestPercentsForOpenNotPositive: the windowed obv is zero or negative, the ratio with it never opens
+func TestPercentsForOpenNotPositive(t *testing.T) {
+	for _, strategyType := range []StrategyType{Long, Short} {
+		strategy := Strategy{Type: strategyType, Op: 100}
+		for _, values := range [][2]float64{{20, 0}, {0, 20}, {20, -300}, {-300, 20}, {-300, -400}} {
+			if percents := strategy.percentsForOpen(values[0], values[1]); percents != 0 {
+				t.Errorf("%s v1:%v v2:%v percents %v", strategyType, values[0], values[1], percents)
+			}
+		}
+		if percents := strategy.percentsForOpen(20, 20); percents <= 0 || percents >= 1 {
+			t.Errorf("%s equal values percents %v", strategyType, percents)
+		}
+	}
+}
+
+// TestCloneAllocations: a snapshot does not allocate the indicator table and does not grow with the history
+func TestCloneAllocations(t *testing.T) {
+	short := newTestCandleData(testCandleSeries(100))
+	long := newTestCandleData(testCandleSeries(1440))
+	warmIndicators(long)
+
+	shortAllocs := testing.AllocsPerRun(10, func() { short.clone() })
+	longAllocs := testing.AllocsPerRun(10, func() { long.clone() })
+	if longAllocs != shortAllocs || longAllocs > 3 {
+		t.Errorf("clone allocations %v of 100 candles, %v of 1440", shortAllocs, longAllocs)
+	}
+
+	clone := long.clone()
+	if clone.Indicators != nil || clone.longIndicators != nil {
+		t.Error("the indicators are copied")
+	}
+	clone.upsertCandle(newCandle(1, 1, 1, 1, 1, clone.lastTime().Add(time.Hour)))
+	for _, barType := range BarTypes[:barTypesCount-1] {
+		if clone.Candles[barType][clone.index()] != 1 || clone.Candles[barType+1][0] == 1 {
+			t.Fatalf("the appended %s candle is not kept apart", barType)
+		}
+	}
+	assertColdRecompute(t, clone, append(testCandleSeries(1440), newCandle(1, 1, 1, 1, 1, clone.lastTime())))
+}
+
+// mapCandleData is the layout before the arrays: maps by bar type, nested maps of indicators,
+// prices read by reflect and the ema sources passed as closures. It is kept for the benchmarks only
+type mapCandleData struct {
+	Time       []time.Time
+	Candles    map[BarType][]float64
+	Indicators map[IndicatorType]map[int]map[BarType][]float64
+}
+
+type mapGet func(n, i int, barType BarType) float64
+
+func newMapCandleData() *mapCandleData {
+	return &mapCandleData{
+		Candles:    make(map[BarType][]float64),
+		Indicators: make(map[IndicatorType]map[int]map[BarType][]float64),
+	}
+}
+
+func mapPrice(candle Candle, barType BarType) float64 {
+	return reflect.Indirect(reflect.ValueOf(candle)).FieldByName(barType.String()).Float()
+}
+
+func (candleData *mapCandleData) upsertCandle(c Candle) bool {
+	l := len(candleData.Time) - 1
+	for i := l; i >= 0 && i >= l-1; i-- {
+		if candleData.Time[i].Equal(c.T) {
+			for _, barType := range BarTypes {
+				candleData.Candles[barType][i] = mapPrice(c, barType)
+			}
+			return false
+		}
+	}
+	if l >= 0 && c.T.Before(candleData.Time[l]) {
+		return false
+	}
+	candleData.Time = append(candleData.Time, c.T)
+	for _, barType := range BarTypes {
+		candleData.Candles[barType] = append(candleData.Candles[barType], mapPrice(c, barType))
+	}
+	return true
+}
+
+func (candleData *mapCandleData) get(indicatorType IndicatorType, fun mapGet, n, i int, barType BarType) float64 {
+	arr := candleData.Indicators[indicatorType][n][barType]
+	if len(arr) > i {
+		return arr[i]
+	}
+	for k := len(arr); k <= i; k++ {
+		arr = append(arr, fun(n, k, barType))
+		candleData.Indicators[indicatorType][n][barType] = arr
+	}
+	return arr[i]
+}
+
+func (candleData *mapCandleData) ema(indicatorType IndicatorType, source, prev mapGet, n, i int, barType BarType) float64 {
+	return candleData.get(indicatorType, func(n, i int, barType BarType) float64 {
+		if i > 0 {
+			return (source(n, i, barType)*float64(n) + float64(100-n)*prev(n, i-1, barType)) * 0.01
+		}
+		return candleData.Candles[barType][i]
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) getCandle(n, i int, barType BarType) float64 {
+	return candleData.Candles[barType][i]
+}
+
+func (candleData *mapCandleData) getSma(n, i int, barType BarType) float64 {
+	return candleData.get(IndicatorTypeSma, func(n, i int, barType BarType) float64 {
+		if i >= n {
+			return candleData.getSma(n, i-1, barType) + (candleData.getCandle(n, i, barType)-candleData.getCandle(n, i-n, barType))/float64(n)
+		} else if i > 0 {
+			return (candleData.getSma(n, i-1, barType)*float64(i) + candleData.getCandle(n, i, barType)) / float64(i+1)
+		}
+		return candleData.getCandle(n, 0, barType)
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) getEma(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorTypeEma, candleData.getCandle, candleData.getEma, n, i, barType)
+}
+
+func (candleData *mapCandleData) get2Ema(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorType2Ema, candleData.getEma, candleData.get2Ema, n, i, barType)
+}
+
+func (candleData *mapCandleData) get3Ema(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorType3Ema, candleData.get2Ema, candleData.get3Ema, n, i, barType)
+}
+
+func (candleData *mapCandleData) getDema(n, i int, barType BarType) float64 {
+	return candleData.get(IndicatorTypeDema, func(n, i int, barType BarType) float64 {
+		return 2*candleData.getEma(n, i, barType) - candleData.get2Ema(n, i, barType)
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) getTema(n, i int, barType BarType) float64 {
+	return candleData.get(IndicatorTypeTema, func(n, i int, barType BarType) float64 {
+		return 3*(candleData.getEma(n, i, barType)-candleData.get2Ema(n, i, barType)) + candleData.get3Ema(n, i, barType)
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) getEmaTema(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorTypeEmaTema, candleData.getTema, candleData.getEmaTema, n, i, barType)
+}
+
+func (candleData *mapCandleData) get2EmaTema(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorType2EmaTema, candleData.getEmaTema, candleData.get2EmaTema, n, i, barType)
+}
+
+func (candleData *mapCandleData) get3EmaTema(n, i int, barType BarType) float64 {
+	return candleData.ema(IndicatorType3EmaTema, candleData.get2EmaTema, candleData.get3EmaTema, n, i, barType)
+}
+
+func (candleData *mapCandleData) get2Tema(n, i int, barType BarType) float64 {
+	return candleData.get(IndicatorType2Tema, func(n, i int, barType BarType) float64 {
+		return 3*(candleData.getEmaTema(n, i, barType)-candleData.get2EmaTema(n, i, barType)) + candleData.get3EmaTema(n, i, barType)
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) getTemaZero(n, i int, barType BarType) float64 {
+	return candleData.get(IndicatorTypeTemaZero, func(n, i int, barType BarType) float64 {
+		return 2*candleData.getTema(n, i, barType) - candleData.get2Tema(n, i, barType)
+	}, n, i, barType)
+}
+
+func (candleData *mapCandleData) fillIndicators() {
+	l := len(candleData.Time) - 1
+	for _, indicatorType := range IndicatorTypes {
+		candleData.Indicators[indicatorType] = make(map[int]map[BarType][]float64)
+	}
+	for n := 3; n <= 70; n++ {
+		for _, indicatorType := range IndicatorTypes {
+			candleData.Indicators[indicatorType][n] = make(map[BarType][]float64)
+		}
+		for _, barType := range BarTypes {
+			candleData.getSma(n, l, barType)
+			candleData.getEma(n, l, barType)
+			candleData.getDema(n, l, barType)
+			candleData.getTema(n, l, barType)
+			candleData.getTemaZero(n, l, barType)
+		}
+	}
+}
+
+// TestMapCandleData: the benchmarks compare the same values
+func TestMapCandleData(t *testing.T) {
+	candles := testCandleSeries(300)
+	candleData := newTestCandleData(candles)
+	old := newMapCandleData()
+	for _, candle := range candles {
+		old.upsertCandle(candle)
+	}
+	old.fillIndicators()
+
+	l := candleData.index()
+	for _, n := range testPeriods {
+		// the search fills 3..70, longer periods of the strategies get their maps here
+		for _, indicatorType := range IndicatorTypes {
+			if old.Indicators[indicatorType][n] == nil {
+				old.Indicators[indicatorType][n] = make(map[BarType][]float64)
+			}
+		}
+		for _, barType := range BarTypes {
+			if got, expected := candleData.getTemaZero(n, l, barType), old.getTemaZero(n, l, barType); got != expected {
+				t.Errorf("tema zero(%d) %s %v, map layout %v", n, barType, got, expected)
+			}
+			if got, expected := candleData.getSma(n, l, barType), old.getSma(n, l, barType); got != expected {
+				t.Errorf("sma(%d) %s %v, map layout %v", n, barType, got, expected)
+			}
+		}
+	}
+}
+
+// benchmarkCandles is the default history depth of the hourly candles
+var benchmarkCandles = testCandleSeries(int(historyCandles))
+
+func BenchmarkFillIndicators(b *testing.B) {
+	candleData := newTestCandleData(benchmarkCandles)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candleData.fillIndicators()
+	}
+}
+
+func BenchmarkFillIndicatorsMapLayout(b *testing.B) {
+	candleData := newMapCandleData()
+	for _, candle := range benchmarkCandles {
+		candleData.upsertCandle(candle)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candleData.fillIndicators()
+	}
+}
+
+// BenchmarkUpsertCandle appends the history and revises the last candle like the stream does
+func BenchmarkUpsertCandle(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		candleData := initCandleData("exmo", "ETC_USDT", defaultResolution)
+		for _, candle := range benchmarkCandles {
+			candleData.upsertCandle(candle)
+			candleData.upsertCandle(candle)
+		}
+	}
+}
+
+func BenchmarkUpsertCandleMapLayout(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		candleData := newMapCandleData()
+		for _, candle := range benchmarkCandles {
+			candleData.upsertCandle(candle)
+			candleData.upsertCandle(candle)
+		}
+	}
+}
+
+func BenchmarkClone(b *testing.B) {
+	candleData := newTestCandleData(benchmarkCandles)
+	candleData.fillIndicators()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candleData.clone()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/fatih/color"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientOrders gives every order a unique client id and keeps the orders whose response is not known yet.
+// The journal is written before the order is sent, so an order lost with the connection or the process
+// is looked up on the exchange instead of being sent again. Orders found after a restart wait for the engine in Found
+type ClientOrders struct {
+	LastId   int64
+	Pending  map[int64]ClientOrder
+	Found    []ClientOrder
+	fileName string
+	mutex    sync.Mutex
+}
+
+type ClientOrder struct {
+	Id      int64
+	Pair    string
+	Type    string
+	Margin  bool
+	OrderId int64
+	Created time.Time
+}
+
+// isEntry is true for the orders that open positions: spot buys and margin sells
+func (order ClientOrder) isEntry() bool {
+	if order.Margin {
+		return order.Type == "market_sell"
+	}
+	return strings.Contains(order.Type, "buy")
+}
+
+func newClientOrders(fileName string) *ClientOrders {
+	orders := &ClientOrders{fileName: fileName}
+	if fileExists(fileName) {
+		dec := gob.NewDecoder(bytes.NewReader(ReadFromFile(fileName)))
+		_ = dec.Decode(orders)
+	}
+	if orders.Pending == nil {
+		orders.Pending = make(map[int64]ClientOrder)
+	}
+	return orders
+}
+
+// add saves the order of the spot or the margin wallet with a new id, ids only grow and start from the time so a lost journal does not repeat them
+func (orders *ClientOrders) add(pair, orderType string, margin bool) (int64, error) {
+	orders.mutex.Lock()
+	defer orders.mutex.Unlock()
+
+	id := orders.LastId + 1
+	if now := time.Now().UnixMilli(); id < now {
+		id = now
+	}
+	orders.LastId = id
+	orders.Pending[id] = ClientOrder{Id: id, Pair: pair, Type: orderType, Margin: margin, Created: time.Now()}
+	if err := orders.backup(); err != nil {
+		delete(orders.Pending, id)
+		return 0, fmt.Errorf("client order journal: %w", err)
+	}
+	return id, nil
+}
+
+// done forgets the order when the exchange answered or the order was found
+func (orders *ClientOrders) done(id int64) {
+	orders.mutex.Lock()
+	defer orders.mutex.Unlock()
+
+	delete(orders.Pending, id)
+	if err := orders.backup(); err != nil {
+		color.HiRed("ERROR client order journal %+v", err)
+	}
+}
+
+func (orders *ClientOrders) pending() []ClientOrder {
+	orders.mutex.Lock()
+	defer orders.mutex.Unlock()
+
+	var result []ClientOrder
+	for _, order := range orders.Pending {
+		result = append(result, order)
+	}
+	return result
+}
+
+func (orders *ClientOrders) backup() error {
+	return os.WriteFile(orders.fileName, EncodeToBytes(orders), 0644)
+}
+
+// takeFound returns the found orders once, the engine adopts them
+func (orders *ClientOrders) takeFound() []ClientOrder {
+	orders.mutex.Lock()
+	defer orders.mutex.Unlock()
+
+	found := orders.Found
+	orders.Found = nil
+	if err := orders.backup(); err != nil {
+		color.HiRed("ERROR client order journal %+v", err)
+	}
+	return found
+}
+
+// checkPending looks for the orders sent before a restart, found ones may be positions the engine does not know
+func (orders *ClientOrders) checkPending(find func(order ClientOrder) (int64, bool, error)) {
+	for _, order := range orders.pending() {
+		orderId, found, err := find(order)
+		switch {
+		case err != nil:
+			color.HiRed("ERROR pending order %d %s %s: %+v", order.Id, order.Pair, order.Type, err)
+			continue
+		case found:
+			color.HiYellow("ORDER %d %s %s of client id %d was placed before the restart", orderId, order.Pair, order.Type, order.Id)
+			order.OrderId = orderId
+			orders.mutex.Lock()
+			orders.Found = append(orders.Found, order)
+			orders.mutex.Unlock()
+		default:
+			color.HiYellow("ORDER %s %s of client id %d was not placed", order.Pair, order.Type, order.Id)
+		}
+		orders.done(order.Id)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Engine opens and closes positions of one account, the exchange is reached only through the ApiInterface
+type Engine struct {
+	Api              ApiInterface
+	Bot              *TgBot
+	Exchange         string
+	AvailableDeposit float64
+	Fees             map[string]PairFee
+	OpenedOrder      OpenedOrder
+	Strategies       []Strategy
+	LiveCandles      map[string]Candle
+	mutex            sync.Mutex
+	// entering is set while a limit entry waits for its fill with the engine unlocked
+	entering bool
+	// blocked pairs have positions the engine does not know, they are not opened until the restart
+	blocked map[string]bool
+	// exitsCheckedAt is the last check of the resting take profit by the price, the ticks do it once per exitsCheckInterval
+	exitsCheckedAt time.Time
+}
+
+// exitsCheckInterval keeps the ticks past the take profit from spending the rate limit while the exchange fills it
+var exitsCheckInterval = 15 * time.Second
+
+type OpenedOrder struct {
+	Strategy
+	OpenedPrice       float64
+	OpenedAt          time.Time
+	Quantity          float64
+	StopLossOrderId   int64
+	StopLossPrice     float64
+	TakeProfitOrderId int64
+	TakeProfitPrice   float64
+	EntryFee          float64
+	ExitFee           float64
+	Fees              float64
+	ReplyToMessageID  int
+}
+
+func (order OpenedOrder) isEmpty() bool {
+	return order.Pair == ""
+}
+
+// netFactor is the part of the money left after the entry and exit fees
+func (order OpenedOrder) netFactor() float64 {
+	return (1 - order.EntryFee) * (1 - order.ExitFee)
+}
+
+func (order OpenedOrder) takeProfitTarget() float64 {
+	return order.takeProfitPrice(order.OpenedPrice, order.netFactor())
+}
+
+// newEngine restores the opened order of the account, exchange is the source of its candles
+func newEngine(api ApiInterface, bot *TgBot, exchange string, availableDeposit float64, fees map[string]PairFee) *Engine {
+	engine := &Engine{
+		Api:              api,
+		Bot:              bot,
+		Exchange:         exchange,
+		AvailableDeposit: availableDeposit,
+		Fees:             fees,
+		LiveCandles:      make(map[string]Candle),
+		blocked:          make(map[string]bool),
+	}
+	engine.restore()
+
+	return engine
+}
+
+func (engine *Engine) restore() bool {
+	fileName := engine.Api.getFileName()
+	if !fileExists(fileName) {
+		return false
+	}
+	dataIn := ReadFromFile(fileName)
+	dec := gob.NewDecoder(bytes.NewReader(dataIn))
+	_ = dec.Decode(&(engine.OpenedOrder))
+	// orders opened before strategies had a resolution
+	if engine.isOrderOpened() && engine.OpenedOrder.Resolution == "" {
+		engine.OpenedOrder.Resolution = defaultResolution
+	}
+	// and before the candles were kept per exchange
+	if engine.isOrderOpened() && engine.OpenedOrder.Exchange == "" {
+		engine.OpenedOrder.Exchange = engine.Exchange
+	}
+
+	return true
+}
+
+func (engine *Engine) backup() {
+	dataOut := EncodeToBytes(engine.OpenedOrder)
+	_ = os.WriteFile(engine.Api.getFileName(), dataOut, 0644)
+}
+
+func (engine *Engine) isOrderOpened() bool {
+	return engine.OpenedOrder.isEmpty() == false
+}
+
+// listen schedules a check at the boundaries of every resolution used by the strategies
+func (engine *Engine) listen(strategies []Strategy) {
+	engine.Strategies = strategies
+	engine.reconcile(strategies)
+	resolutions, groups := groupByResolution(strategies)
+	for _, resolution := range resolutions {
+		_, _ = scheduler.Cron(resolution.cron()).Do(engine.checkOperation, resolution, groups[resolution])
+	}
+	engine.Api.listenPrices(strategies, engine.onTick)
+}
+
+// checkOperation runs when a candle of the resolution is closed,
+// the opened position is closed only by the candles of its own strategy
+func (engine *Engine) checkOperation(resolution Resolution, strategies []Strategy) {
+	time.Sleep(time.Second * 1)
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	color.HiBlue("%s %s %s\n", time.Now().Format("02.01.06 15:04:05"), resolution, engine.Api)
+	engine.Api.downloadNewCandleForStrategies(getUniqueStrategies(strategies))
+	if engine.isOrderOpened() {
+		engine.checkExitOrders()
+	}
+	if engine.isOrderOpened() {
+		if engine.OpenedOrder.Resolution == resolution {
+			engine.checkForClose()
+			if engine.isOrderOpened() {
+				var price float64
+				engine.OpenedOrder.updateCandles(func(candleData *CandleData) {
+					if i := candleData.closedIndex(); i >= 0 {
+						price = candleData.Candles[C][i]
+					}
+				})
+				if price > 0 {
+					engine.trailStopLoss(price)
+				}
+			}
+		}
+	} else {
+		engine.checkForOpen(strategies)
+	}
+}
+
+func (engine *Engine) checkForOpen(strategies []Strategy) {
+	if engine.entering {
+		color.HiYellow("ENTRY is waiting for its limit order")
+		return
+	}
+	balances, err := engine.Api.getBalances()
+	if err != nil {
+		color.HiRed("ERROR balances %+v", err)
+		return
+	}
+	var marginBalances Balances
+
+	for _, strategy := range strategies {
+		if engine.blocked[strategy.Pair] {
+			color.HiYellow("ENTRY %s is blocked by an unknown position", strategy.Pair)
+			continue
+		}
+		var v1, v2 float64
+		volumeOk, loaded := false, false
+		strategy.updateCandles(func(candleData *CandleData) {
+			index := candleData.closedIndex()
+			if loaded = index >= 0; !loaded {
+				return
+			}
+			v1 = candleData.fillIndicator(index, strategy.Ind1)
+			v2 = candleData.fillIndicator(index, strategy.Ind2)
+			volumeOk = strategy.Volume.check(candleData, index)
+		})
+		if !loaded {
+			color.HiYellow("ENTRY %s %s has no candles yet", strategy.Pair, strategy.Resolution)
+			continue
+		}
+
+		percentsForOpen := strategy.percentsForOpen(v1, v2)
+		if percentsForOpen > 1.0 && !volumeOk {
+			fmt.Printf("%.4f strategy:%+v low volume\n", percentsForOpen, strategy)
+		} else if percentsForOpen > 1.0 {
+			pair := strategy.Pair
+			candle := engine.Api.downloadNewCandle(0, pair, strategy.Resolution)
+			if candle.isEmpty() {
+				continue
+			}
+			walletBalances := balances
+			if strategy.isShort() {
+				if marginBalances == nil {
+					if marginBalances, err = engine.Api.margin().getBalances(); err != nil {
+						color.HiRed("ERROR margin balances %+v", err)
+						continue
+					}
+				}
+				walletBalances = marginBalances
+			}
+			money := walletBalances.available(getRightCurrency(pair)) * engine.AvailableDeposit
+			openedOrder, err := engine.openPosition(strategy, money, candle)
+			if err == nil {
+				color.HiGreen("SUCCESS order open-> price:%s quantity:%s fee:%s", f2s(openedOrder.OpenedPrice), f2s(openedOrder.Quantity), f2s(openedOrder.Fees))
+				engine.setOpenedOrder(openedOrder)
+			} else {
+				color.HiRed("ERROR order open-> %+v", err)
+			}
+			fmt.Printf("OpenedOrder:%+v\n\n", engine.OpenedOrder)
+		} else {
+			fmt.Printf("%.4f strategy:%+v v1:%f v2:%f\n", percentsForOpen, strategy, v1, v2)
+		}
+	}
+}
+
+// setOpenedOrder places the exit orders of the new position and announces it
+func (engine *Engine) setOpenedOrder(openedOrder OpenedOrder) {
+	price := openedOrder.OpenedPrice
+
+	// выставляем стоп лосс и тейк профит
+	stopLossPrice := openedOrder.stopLossPrice(price)
+	if err := engine.placeExitOrders(&openedOrder, stopLossPrice); err != nil {
+		color.HiRed("ERROR set exit orders %+v", err)
+	}
+
+	screen := openedOrder.candlesSnapshot().drawBars(openedOrder.takeProfitTarget(), stopLossPrice)
+	openedOrder.ReplyToMessageID = engine.Bot.newOrderOpened(openedOrder.Strategy, price, stopLossPrice, screen)
+
+	engine.OpenedOrder = openedOrder
+	engine.backup()
+}
+
+func (engine *Engine) checkForClose() {
+	pair, resolution := engine.OpenedOrder.Pair, engine.OpenedOrder.Resolution
+	candle := engine.Api.downloadNewCandle(0, pair, resolution)
+	if candle.isEmpty() {
+		time.Sleep(time.Second * 30)
+		candle = engine.Api.downloadNewCandle(0, pair, resolution)
+		if candle.isEmpty() {
+			return
+		}
+	}
+	fmt.Printf("Percents to close: %f\n", engine.percentsToClose(candle.O))
+	engine.closeByPrice(candle.O)
+}
+
+func (engine *Engine) percentsToClose(price float64) float64 {
+	return engine.OpenedOrder.percentsToClose(engine.OpenedOrder.OpenedPrice, price, engine.OpenedOrder.netFactor())
+}
+
+// exitQuantity is the size of the exit orders: the bought coins less the entry fee paid in coins,
+// a short buys back the sold coins with the fee of the buy on top
+func (engine *Engine) exitQuantity(openedOrder OpenedOrder) (float64, error) {
+	info, err := engine.Api.getPairInfo(openedOrder.Pair)
+	if err != nil {
+		return 0, err
+	}
+	if openedOrder.isShort() {
+		return openedOrder.Quantity / (1 - info.TakerFee), nil
+	}
+	return info.roundQuantity(openedOrder.Quantity * (1 - openedOrder.EntryFee)), nil
+}
+
+// restsTakeProfit is true when the wallet of the position holds the take profit next to the stop loss.
+// Exmo spot reserves the coins of a long for one order, the stop loss has them and the Tp is closed by market
+func (engine *Engine) restsTakeProfit(openedOrder OpenedOrder) bool {
+	_, ok := engine.wallet(openedOrder).(OcoApi)
+	return ok
+}
+
+// placeExitOrders places the stop loss and the take profit at the Tp of the strategy as oco,
+// the wallets without oco get only the stop loss
+func (engine *Engine) placeExitOrders(openedOrder *OpenedOrder, stopLossPrice float64) error {
+	pair := openedOrder.Pair
+	quantity, err := engine.exitQuantity(*openedOrder)
+	if err != nil {
+		return err
+	}
+
+	wallet := engine.wallet(*openedOrder)
+	oco, ok := wallet.(OcoApi)
+	if !ok {
+		stopId, err := wallet.placeStop(pair, openedOrder.closingSide(), quantity, stopLossPrice)
+		if err != nil {
+			return err
+		}
+		openedOrder.StopLossOrderId = stopId
+		openedOrder.StopLossPrice = stopLossPrice
+		return nil
+	}
+
+	price := openedOrder.takeProfitTarget()
+	orderId, stopId, err := oco.placeOco(pair, openedOrder.closingSide(), quantity, price, stopLossPrice)
+	if stopId != 0 {
+		openedOrder.StopLossOrderId = stopId
+		openedOrder.StopLossPrice = stopLossPrice
+	}
+	if orderId != 0 {
+		openedOrder.TakeProfitOrderId = orderId
+		openedOrder.TakeProfitPrice = price
+	}
+	return err
+}
+
+// replaceStopLoss moves the stop loss to the price. The take profit is cancelled with it and placed again
+// as oco. A stop that failed to be placed is placed again by reconcile
+func (engine *Engine) replaceStopLoss(stopLossPrice float64) error {
+	openedOrder := &engine.OpenedOrder
+	pair := openedOrder.Pair
+	wallet := engine.wallet(*openedOrder)
+	defer engine.backup()
+
+	if openedOrder.StopLossOrderId != 0 {
+		if err := wallet.cancelStop(pair, openedOrder.StopLossOrderId); err != nil {
+			return fmt.Errorf("cancel stopLoss %d: %w", openedOrder.StopLossOrderId, err)
+		}
+		openedOrder.StopLossOrderId = 0
+	}
+	// binance cancels the take profit of the list with the stop
+	if takeProfitId := openedOrder.TakeProfitOrderId; takeProfitId != 0 {
+		if err := wallet.cancelOrder(pair, takeProfitId); err != nil && !errors.Is(err, ErrOrderNotFound) {
+			return fmt.Errorf("cancel takeProfit %d: %w", takeProfitId, err)
+		}
+		openedOrder.TakeProfitOrderId = 0
+		openedOrder.TakeProfitPrice = 0
+	}
+
+	return engine.placeExitOrders(openedOrder, stopLossPrice)
+}
+
+// closeByPrice closes by market at the Tp when there is no take profit order, otherwise the exchange fills it
+func (engine *Engine) closeByPrice(price float64) {
+	openedOrder := engine.OpenedOrder
+	pair := openedOrder.Pair
+	if engine.percentsToClose(price) < 1.0 {
+		return
+	}
+	if openedOrder.TakeProfitOrderId != 0 {
+		if time.Since(engine.exitsCheckedAt) >= exitsCheckInterval {
+			engine.exitsCheckedAt = time.Now()
+			engine.checkExitOrders()
+		}
+		return
+	}
+
+	if engine.OpenedOrder.StopLossOrderId != 0 {
+		err := engine.wallet(openedOrder).cancelStop(pair, engine.OpenedOrder.StopLossOrderId)
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			color.HiRed("ERROR cancel stopLoss %+v", err)
+			return
+		}
+		engine.OpenedOrder.StopLossOrderId = 0
+		engine.OpenedOrder.StopLossPrice = 0
+		engine.backup()
+	}
+
+	orderId, err := engine.closePosition(price)
+	if err == nil {
+		fees := engine.OpenedOrder.Fees + engine.exitFee(orderId, price)
+		color.HiGreen("SUCCESS order close-> fees:%s", f2s(fees))
+		engine.Bot.orderClosed(pair, price, fees, engine.OpenedOrder.ReplyToMessageID)
+		engine.OpenedOrder = OpenedOrder{}
+		engine.backup()
+	} else {
+		color.HiRed("ERROR order close-> %+v", err)
+	}
+	fmt.Printf("Operation:%+v\nOrder:%d\n\n", openedOrder, orderId)
+}
+
+// closePosition sells the coins of a long or buys back the coins of a short
+func (engine *Engine) closePosition(price float64) (int64, error) {
+	pair := engine.OpenedOrder.Pair
+	if engine.OpenedOrder.isShort() {
+		return engine.closeShort(price)
+	}
+
+	quantity, err := engine.exitQuantity(engine.OpenedOrder)
+	if err != nil {
+		return 0, err
+	}
+	balances, err := engine.Api.getBalances()
+	if err != nil {
+		return 0, err
+	}
+	// the fee may be paid in other coins
+	quantity = math.Min(quantity, balances.available(getLeftCurrency(pair)))
+
+	return engine.Api.placeMarketOrder(pair, "sell", quantity, price)
+}
+
+// onTick updates the live candle with trades and checks the opened position on every price change
+func (engine *Engine) onTick(pair string, price, quantity float64, t time.Time, isTrade bool) {
+	if price <= 0 {
+		return
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	if isTrade {
+		for _, strategy := range getUniqueStrategies(engine.Strategies) {
+			if strategy.Pair != pair {
+				continue
+			}
+			strategy.updateCandles(func(candleData *CandleData) {
+				candleData.upsertCandle(engine.updateLiveCandle(candleData, price, quantity, t))
+			})
+		}
+	}
+
+	if engine.isOrderOpened() && engine.OpenedOrder.Pair == pair {
+		engine.closeByPrice(price)
+	}
+	if engine.isOrderOpened() && engine.OpenedOrder.Pair == pair {
+		engine.trailStopLoss(price)
+	}
+}
+
+// updateLiveCandle adds the trade to the candle being formed
+func (engine *Engine) updateLiveCandle(candleData *CandleData, price, quantity float64, t time.Time) Candle {
+	start := t.Truncate(candleData.Resolution.duration())
+	candle, ok := engine.LiveCandles[candleData.key()]
+	if !ok || !candle.T.Equal(start) {
+		candle = newCandle(price, price, price, price, 0, start)
+		// the candle may already be known from the history download
+		if i := candleData.index(); i >= 0 && candleData.Time[i].Equal(start) {
+			candle = newCandle(
+				candleData.Candles[L][i], candleData.Candles[O][i], candleData.Candles[C][i], candleData.Candles[H][i],
+				candleData.Candles[V][i], start,
+			)
+		}
+	}
+
+	// the volume is counted from the series, the download of the candle replaces it with the exchange one
+	volume := candle.V
+	if i := candleData.index(); i >= 0 && candleData.Time[i].Equal(start) {
+		volume = candleData.Candles[V][i]
+	}
+	candle = newCandle(math.Min(candle.L, price), candle.O, price, math.Max(candle.H, price), volume+quantity, start)
+	engine.LiveCandles[candleData.key()] = candle
+
+	return candle
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"time"
+)
+
+// openPosition spends money of the right currency, shorts use the money of the margin wallet as the collateral
+func (engine *Engine) openPosition(strategy Strategy, money float64, candle Candle) (OpenedOrder, error) {
+	openedAt := time.Now()
+
+	var fill OrderStatus
+	var err error
+	if strategy.isShort() {
+		fill, err = engine.openShort(strategy.Pair, money, candle.O)
+	} else {
+		fill, err = engine.openLong(strategy, money, candle)
+	}
+	if err != nil {
+		return OpenedOrder{Strategy: strategy, OpenedAt: openedAt}, err
+	}
+
+	return engine.newOpenedOrder(strategy, fill, openedAt), nil
+}
+
+// newOpenedOrder is the position of the filled entry, fill.Fee is the entry fee
+func (engine *Engine) newOpenedOrder(strategy Strategy, fill OrderStatus, openedAt time.Time) OpenedOrder {
+	return OpenedOrder{
+		Strategy:    strategy,
+		OpenedAt:    openedAt,
+		OpenedPrice: fill.Amount / fill.Quantity,
+		Quantity:    fill.Quantity,
+		EntryFee:    fill.Fee / fill.Amount,
+		ExitFee:     engine.pairFee(strategy.Pair).Taker,
+		Fees:        fill.Fee,
+	}
+}
+
+// openLong buys according to the strategy entry and returns bought coins, spent money and fees
+func (engine *Engine) openLong(strategy Strategy, money float64, candle Candle) (OrderStatus, error) {
+	if strategy.Entry.Type == EntryMarket {
+		return engine.marketEntry(strategy.Pair, money, candle.O)
+	}
+
+	pair := strategy.Pair
+	price, err := engine.entryPrice(strategy, candle)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+
+	orderId, err := engine.Api.placeLimitOrder(pair, "buy", money/price, price)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	color.HiBlue("LIMIT order %d %s price:%s, waiting %ds", orderId, pair, f2s(price), strategy.Entry.Timeout)
+
+	engine.entering = true
+	status, err := engine.waitOrder(pair, orderId, time.Duration(strategy.Entry.Timeout)*time.Second)
+	engine.entering = false
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	filled := !status.Open
+	if !filled {
+		err = engine.Api.cancelOrder(pair, orderId)
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			// the order may still be filled later, it is safer to stop here
+			return OrderStatus{}, fmt.Errorf("cancel limit order %d: %w", orderId, err)
+		}
+		if status, err = engine.Api.getOrderStatus(pair, orderId); err != nil {
+			return OrderStatus{}, err
+		}
+	}
+	fill := OrderStatus{Quantity: status.Quantity, Amount: status.Amount, Fee: orderFee(status, engine.pairFee(pair).Maker)}
+	color.HiBlue("LIMIT order %d filled %s of %s", orderId, f2s(fill.Quantity), f2s(money/price))
+
+	if !filled && strategy.Entry.Fallback {
+		market, err := engine.marketEntry(pair, money-fill.Amount, candle.O)
+		if err != nil && fill.Quantity == 0 {
+			return OrderStatus{}, err
+		}
+		if err != nil {
+			color.HiYellow("MARKET fallback %s skipped: %+v", pair, err)
+		}
+		fill.Quantity += market.Quantity
+		fill.Amount += market.Amount
+		fill.Fee += market.Fee
+	}
+
+	if fill.Quantity == 0 {
+		return OrderStatus{}, &OrderRejectedError{Pair: pair, Reason: fmt.Sprintf("limit order %d was not filled in %ds", orderId, strategy.Entry.Timeout)}
+	}
+
+	return fill, nil
+}
+
+// entryPrice is the best bid or the candle open shifted by the entry offset
+func (engine *Engine) entryPrice(strategy Strategy, candle Candle) (float64, error) {
+	price := candle.O
+	if strategy.Entry.Type == EntryBid {
+		bid, err := engine.Api.getBestBid(strategy.Pair)
+		if err != nil {
+			return 0, err
+		}
+		price = bid
+	}
+	return price * float64(10000+strategy.Entry.Offset) / 10000, nil
+}
+
+// marketEntry buys by market, the candle open is taken when the fill of the order is unknown
+func (engine *Engine) marketEntry(pair string, money, price float64) (OrderStatus, error) {
+	orderId, err := engine.Api.marketBuyTotal(pair, money, price)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+
+	status, err := engine.Api.getOrderStatus(pair, orderId)
+	if err != nil {
+		color.HiRed("ERROR order status %+v", err)
+	}
+	if status.Quantity == 0 {
+		status = OrderStatus{Quantity: money / price, Amount: money}
+	}
+	status.Fee = orderFee(status, engine.pairFee(pair).Taker)
+
+	return status, nil
+}
+
+// waitOrder polls the order until it is closed or the timeout passes, the last status is returned.
+// It is called with the engine locked and unlocks it between the polls, so the stream ticks are not stalled
+func (engine *Engine) waitOrder(pair string, orderId int64, timeout time.Duration) (OrderStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := engine.Api.getOrderStatus(pair, orderId)
+		if err != nil {
+			color.HiRed("ERROR order status %+v", err)
+		} else if !status.Open || time.Now().After(deadline) {
+			return status, nil
+		}
+		if time.Now().After(deadline) {
+			return status, err
+		}
+		engine.mutex.Unlock()
+		time.Sleep(time.Second)
+		engine.mutex.Lock()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLimitEntryDoesNotBlockTicks: the limit order below the market waits for its timeout,
+// meanwhile the ticks are handled and no other entry is started
+func TestLimitEntryDoesNotBlockTicks(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	strategy := testStrategy("ETC_USDT", Long)
+	strategy.Entry = Entry{Type: EntryOpen, Offset: -500, Timeout: 2}
+	engine := newTestEngine(t, exmo, strategy)
+
+	done := make(chan bool)
+	go func() {
+		engine.mutex.Lock()
+		defer engine.mutex.Unlock()
+		engine.checkForOpen(engine.Strategies)
+		close(done)
+	}()
+	waitFor(t, "the limit order", func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		return len(fake.Orders) == 1
+	})
+
+	start := time.Now()
+	engine.onTick("ETC_USDT", 21.5, 1, time.Now(), true)
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("the tick waited %s for the entry", elapsed)
+	}
+
+	engine.mutex.Lock()
+	engine.checkForOpen(engine.Strategies)
+	engine.mutex.Unlock()
+	fake.Lock()
+	orders := len(fake.Orders)
+	fake.Unlock()
+	if orders != 1 {
+		t.Errorf("orders %d while the entry is waiting", orders)
+	}
+
+	<-done
+	if engine.isOrderOpened() {
+		t.Errorf("opened %+v", engine.OpenedOrder)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.Orders) != 0 || fake.Balance["USDT"] != 1000 {
+		t.Errorf("orders %d, money %f after the timeout", len(fake.Orders), fake.Balance["USDT"])
+	}
+}
+
+// TestVolumeFilterBlocksEntry: the signal is there, the volume of the closed candle is below the average times Ratio
+func TestVolumeFilterBlocksEntry(t *testing.T) {
+	for ratio, opened := range map[float64]bool{2: false, 1: true} {
+		exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+		strategy := testStrategy("ETC_USDT", Long)
+		strategy.Volume = VolumeFilter{Ratio: ratio, Period: 20}
+		engine := newTestEngine(t, exmo, strategy)
+
+		engine.checkForOpen(engine.Strategies)
+		if engine.isOrderOpened() != opened {
+			t.Errorf("volume %vx: opened %t, expected %t", ratio, engine.isOrderOpened(), opened)
+		}
+		fake.Lock()
+		if !opened && (len(fake.Orders) != 0 || fake.Balance["USDT"] != 1000) {
+			t.Errorf("volume %vx: orders %d, money %f", ratio, len(fake.Orders), fake.Balance["USDT"])
+		}
+		fake.Unlock()
+	}
+}
+
+// TestObvDoesNotOpen: the windowed obv of flat candles is zero, the ratio with it is infinite and was an entry
+func TestObvDoesNotOpen(t *testing.T) {
+	exmo, _ := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20)})
+	strategy := testStrategy("ETC_USDT", Short)
+	strategy.Ind1 = Indicator{IndicatorType: IndicatorTypeObv, BarType: C, Coef: 10}
+	engine := newTestEngine(t, exmo, strategy)
+
+	engine.checkForOpen(engine.Strategies)
+	if engine.isOrderOpened() {
+		t.Errorf("opened by obv, price %f", engine.OpenedOrder.OpenedPrice)
+	}
+}
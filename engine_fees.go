@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/fatih/color"
+	"strings"
+)
+
+// PairFee is the commission of the pair in fractions of the amount
+type PairFee struct {
+	Taker float64
+	Maker float64
+}
+
+// parseFees parses "ETC_USDT:0.3/0.2,BTC_USDT:0.1", taker/maker in percents, maker is the taker when omitted
+func parseFees(s string) map[string]PairFee {
+	fees := make(map[string]PairFee)
+	for _, item := range strings.Split(s, ",") {
+		pair, value, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			continue
+		}
+		taker, maker, ok := strings.Cut(value, "/")
+		if !ok {
+			maker = taker
+		}
+		fees[pair] = PairFee{Taker: s2f(taker) / 100, Maker: s2f(maker) / 100}
+	}
+	return fees
+}
+
+// pairFee prefers the configured fee to the one of the exchange
+func (engine *Engine) pairFee(pair string) PairFee {
+	if fee, ok := engine.Fees[pair]; ok {
+		return fee
+	}
+	info, err := engine.Api.getPairInfo(pair)
+	if err != nil {
+		color.HiRed("ERROR pair fee %s %+v", pair, err)
+		return PairFee{}
+	}
+	return PairFee{Taker: info.TakerFee, Maker: info.MakerFee}
+}
+
+// orderFee is the fee reported by the exchange or the estimate by the rate
+func orderFee(status OrderStatus, rate float64) float64 {
+	if status.Fee > 0 {
+		return status.Fee
+	}
+	return status.Amount * rate
+}
+
+// exitFee is the fee of the closing order, the price is taken when the fill is unknown
+func (engine *Engine) exitFee(orderId int64, price float64) float64 {
+	status, err := engine.wallet(engine.OpenedOrder).getOrderStatus(engine.OpenedOrder.Pair, orderId)
+	if err != nil || status.Quantity == 0 {
+		status = OrderStatus{Quantity: engine.OpenedOrder.Quantity, Amount: engine.OpenedOrder.Quantity * price}
+	}
+	return orderFee(status, engine.OpenedOrder.ExitFee)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/fatih/color"
+)
+
+// wallet is the spot wallet of longs and the margin wallet of shorts, the exit orders of a position are in its wallet
+func (engine *Engine) wallet(openedOrder OpenedOrder) OrderApi {
+	if openedOrder.isShort() {
+		return engine.Api.margin()
+	}
+	return engine.Api
+}
+
+// openShort sells coins on the margin wallet, the exchange lends them against the money with the leverage.
+// Returns sold coins, received money and fees. The entry of short strategies is always a market order
+func (engine *Engine) openShort(pair string, money, price float64) (OrderStatus, error) {
+	info, err := engine.Api.getPairInfo(pair)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	quantity := info.roundQuantity(money / price)
+
+	margin := engine.Api.margin()
+	orderId, err := margin.placeMarketOrder(pair, "sell", quantity, price)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	color.HiBlue("SHORT order %d %s %s", orderId, pair, f2s(quantity))
+
+	status, err := margin.getOrderStatus(pair, orderId)
+	if err != nil {
+		color.HiRed("ERROR order status %+v", err)
+	}
+	if status.Quantity > 0 {
+		price = status.Amount / status.Quantity
+	}
+	fill := OrderStatus{Quantity: quantity, Amount: quantity * price, Fee: status.Fee}
+	fill.Fee = orderFee(fill, info.TakerFee)
+
+	return fill, nil
+}
+
+// closeShort buys back the sold coins with the taker fee on top, the position of the margin wallet is closed then
+func (engine *Engine) closeShort(price float64) (int64, error) {
+	quantity, err := engine.exitQuantity(engine.OpenedOrder)
+	if err != nil {
+		return 0, err
+	}
+	return engine.Api.margin().placeMarketOrder(engine.OpenedOrder.Pair, "buy", quantity, price)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"time"
+)
+
+// reconcile compares the saved opened order with stop orders, take profit, balances and trades on the exchange.
+// The bot may have been stopped while the stop loss or the take profit was executed or replaced by hand.
+func (engine *Engine) reconcile(strategies []Strategy) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+
+	engine.adoptFoundOrders(strategies)
+	if engine.isOrderOpened() {
+		if ok, err := engine.reconcileOpenedOrder(); err != nil {
+			color.HiRed("ERROR reconcile %+v", err)
+		} else if ok {
+			color.HiGreen("RECONCILE %s ok, stopLoss %d, takeProfit %d",
+				engine.OpenedOrder.Pair, engine.OpenedOrder.StopLossOrderId, engine.OpenedOrder.TakeProfitOrderId,
+			)
+		}
+		return
+	}
+
+	for _, pair := range getUniquePairs(strategies) {
+		stopOrders, err := engine.Api.getStopOrders(pair)
+		if err != nil {
+			color.HiRed("ERROR reconcile %+v", err)
+			return
+		}
+		for _, stopOrder := range stopOrders {
+			color.HiYellow("RECONCILE unknown stop order %s %d trigger:%f", pair, stopOrder.Id, stopOrder.TriggerPrice)
+		}
+	}
+}
+
+// adoptFoundOrders takes the entries sent before the restart: the filled one becomes the opened order of its strategy.
+// The pair of an entry that can not be adopted is blocked, its position has to be closed by hand.
+// Found exit orders are checked by reconcileOpenedOrder
+func (engine *Engine) adoptFoundOrders(strategies []Strategy) {
+	for _, order := range engine.Api.foundOrders() {
+		if !order.isEntry() {
+			continue
+		}
+		var change string
+		strategy, ok := findEntryStrategy(strategies, order)
+		switch {
+		case engine.isOrderOpened():
+			change = fmt.Sprintf("order %d %s is found, the position is %s", order.OrderId, order.Type, engine.OpenedOrder.Pair)
+		case !ok:
+			change = fmt.Sprintf("order %d %s is found, no strategy for it", order.OrderId, order.Type)
+		default:
+			err := engine.adoptOrder(strategy, order)
+			if err == nil {
+				continue
+			}
+			change = fmt.Sprintf("order %d %s is found, adopt error: %+v", order.OrderId, order.Type, err)
+		}
+
+		color.HiRed("RECONCILE %s %s, opening is blocked", order.Pair, change)
+		engine.blocked[order.Pair] = true
+		engine.Bot.reconciled(order.Pair, []string{change, "opening is blocked until the restart"}, 0)
+	}
+}
+
+// findEntryStrategy is the first strategy of the pair that opens positions with the order
+func findEntryStrategy(strategies []Strategy, order ClientOrder) (Strategy, bool) {
+	for _, strategy := range strategies {
+		if strategy.Pair == order.Pair && strategy.isShort() == order.Margin {
+			return strategy, true
+		}
+	}
+	return Strategy{}, false
+}
+
+// adoptOrder opens the position of the found entry, a limit entry that still waits is cancelled
+func (engine *Engine) adoptOrder(strategy Strategy, order ClientOrder) error {
+	wallet := engine.wallet(OpenedOrder{Strategy: strategy})
+	status, err := wallet.getOrderStatus(order.Pair, order.OrderId)
+	if err != nil {
+		return err
+	}
+	if status.Open {
+		if err = wallet.cancelOrder(order.Pair, order.OrderId); err != nil && !errors.Is(err, ErrOrderNotFound) {
+			return err
+		}
+		if status, err = wallet.getOrderStatus(order.Pair, order.OrderId); err != nil {
+			return err
+		}
+	}
+	if status.Quantity == 0 {
+		color.HiYellow("RECONCILE %s order %d was not filled", order.Pair, order.OrderId)
+		return nil
+	}
+
+	status.Fee = orderFee(status, engine.pairFee(order.Pair).Taker)
+	openedOrder := engine.newOpenedOrder(strategy, status, order.Created)
+	color.HiGreen("RECONCILE %s order %d is adopted price:%s quantity:%s",
+		order.Pair, order.OrderId, f2s(openedOrder.OpenedPrice), f2s(openedOrder.Quantity),
+	)
+	engine.setOpenedOrder(openedOrder)
+
+	return nil
+}
+
+// checkExitOrders is called every cycle while the order is opened, the stop loss or the take profit
+// may have been executed since the last one. They work as OCO: when one is filled the other is cancelled
+func (engine *Engine) checkExitOrders() {
+	if _, err := engine.reconcileOpenedOrder(); err != nil {
+		color.HiRed("ERROR check exit orders %+v", err)
+	}
+}
+
+// reconcileOpenedOrder returns true when the opened order matches the exchange state
+func (engine *Engine) reconcileOpenedOrder() (bool, error) {
+	pair := engine.OpenedOrder.Pair
+	stopOrders, err := engine.wallet(engine.OpenedOrder).getStopOrders(pair)
+	if err != nil {
+		return false, err
+	}
+	takeProfit, err := engine.takeProfitStatus(pair)
+	if err != nil {
+		return false, err
+	}
+	if !takeProfit.Open && takeProfit.Quantity > 0 {
+		engine.takeProfitExecuted(takeProfit)
+		return false, nil
+	}
+	if !engine.hasStopLoss(stopOrders) {
+		fill, executed, err := engine.findStopLossTrade(pair)
+		if err != nil {
+			return false, err
+		}
+		if executed {
+			engine.stopLossExecuted(fill)
+			return false, nil
+		}
+	}
+
+	changes := engine.reconcileStopLoss(pair, stopOrders)
+	if !takeProfit.Open && len(changes) == 0 && engine.restsTakeProfit(engine.OpenedOrder) {
+		changes = engine.reconcileTakeProfit()
+	}
+	if len(changes) == 0 {
+		return true, nil
+	}
+
+	for _, change := range changes {
+		color.HiYellow("RECONCILE %s %s", pair, change)
+	}
+	engine.Bot.reconciled(pair, changes, engine.OpenedOrder.ReplyToMessageID)
+	engine.backup()
+
+	return false, nil
+}
+
+func (engine *Engine) hasStopLoss(stopOrders []StopOrder) bool {
+	for _, stopOrder := range stopOrders {
+		if stopOrder.Id == engine.OpenedOrder.StopLossOrderId {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileStopLoss fixes the stop loss of the opened order that was not executed and returns human readable changes
+func (engine *Engine) reconcileStopLoss(pair string, stopOrders []StopOrder) []string {
+	if engine.hasStopLoss(stopOrders) {
+		return nil
+	}
+
+	if len(stopOrders) > 0 {
+		stopOrder := stopOrders[0]
+		change := fmt.Sprintf("stopLoss id %d -> %d, trigger %s", engine.OpenedOrder.StopLossOrderId, stopOrder.Id, f2s(stopOrder.TriggerPrice))
+		engine.OpenedOrder.StopLossOrderId = stopOrder.Id
+		engine.OpenedOrder.StopLossPrice = stopOrder.TriggerPrice
+		return []string{change}
+	}
+
+	quantity, err := engine.exitQuantity(engine.OpenedOrder)
+	if err != nil {
+		return []string{fmt.Sprintf("pair info error: %+v", err)}
+	}
+	changes := []string{fmt.Sprintf("no stopLoss for %s coins", f2s(quantity))}
+	// a trailing stop keeps its last price
+	stopLossPrice := engine.OpenedOrder.StopLossPrice
+	if stopLossPrice == 0 {
+		stopLossPrice = engine.OpenedOrder.stopLossPrice(engine.OpenedOrder.OpenedPrice)
+	}
+	// the stop is gone, only a resting take profit is cancelled
+	engine.OpenedOrder.StopLossOrderId = 0
+	if err = engine.replaceStopLoss(stopLossPrice); err != nil {
+		return append(changes, fmt.Sprintf("set stopLoss error: %+v", err))
+	}
+	return append(changes, fmt.Sprintf("stopLoss %d set at %s", engine.OpenedOrder.StopLossOrderId, f2s(stopLossPrice)))
+}
+
+// takeProfitStatus is empty when the order was not placed
+func (engine *Engine) takeProfitStatus(pair string) (OrderStatus, error) {
+	if engine.OpenedOrder.TakeProfitOrderId == 0 {
+		return OrderStatus{}, nil
+	}
+	return engine.wallet(engine.OpenedOrder).getOrderStatus(pair, engine.OpenedOrder.TakeProfitOrderId)
+}
+
+// reconcileTakeProfit places the take profit again when it is missing or was cancelled by hand.
+// It shares the coins with the stop loss, so both are placed again as oco
+func (engine *Engine) reconcileTakeProfit() []string {
+	changes := []string{"no takeProfit"}
+	if engine.OpenedOrder.TakeProfitOrderId != 0 {
+		changes = []string{fmt.Sprintf("takeProfit %d cancelled", engine.OpenedOrder.TakeProfitOrderId)}
+		engine.OpenedOrder.TakeProfitOrderId = 0
+		engine.OpenedOrder.TakeProfitPrice = 0
+	}
+
+	if err := engine.replaceStopLoss(engine.OpenedOrder.StopLossPrice); err != nil {
+		return append(changes, fmt.Sprintf("set takeProfit error: %+v", err))
+	}
+	return append(changes, fmt.Sprintf("takeProfit %d set at %s, stopLoss %d",
+		engine.OpenedOrder.TakeProfitOrderId, f2s(engine.OpenedOrder.TakeProfitPrice), engine.OpenedOrder.StopLossOrderId,
+	))
+}
+
+// findStopLossTrade returns true when the trades have the fill of the stop loss order
+func (engine *Engine) findStopLossTrade(pair string) (Trade, bool, error) {
+	openedOrder := engine.OpenedOrder
+	if openedOrder.StopLossOrderId == 0 {
+		return Trade{}, false, nil
+	}
+
+	trades, err := engine.wallet(openedOrder).getTrades(pair, 100)
+	if err != nil {
+		return Trade{}, false, err
+	}
+	for _, trade := range trades {
+		if trade.StopId == openedOrder.StopLossOrderId && trade.Side == openedOrder.closingSide() &&
+			trade.Date >= openedOrder.OpenedAt.Unix() {
+			return trade, true, nil
+		}
+	}
+	return Trade{}, false, nil
+}
+
+// stopLossExecuted records the fill and forgets the opened order
+func (engine *Engine) stopLossExecuted(fill Trade) {
+	openedOrder := engine.OpenedOrder
+	color.HiRed("STOPLOSS %d executed %s price:%s quantity:%s at %s",
+		openedOrder.StopLossOrderId, openedOrder.Pair, f2s(fill.Price), f2s(fill.Quantity),
+		time.Unix(fill.Date, 0).Format("02.01.06 15:04:05"),
+	)
+	fee := fill.Fee
+	if fee == 0 {
+		fee = fill.Price * fill.Quantity * openedOrder.ExitFee
+	}
+	engine.Bot.stopLossExecuted(openedOrder.Pair, fill.Price, fill.Quantity, openedOrder.Fees+fee, openedOrder.ReplyToMessageID)
+	if openedOrder.TakeProfitOrderId != 0 {
+		err := engine.wallet(openedOrder).cancelOrder(openedOrder.Pair, openedOrder.TakeProfitOrderId)
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			color.HiRed("ERROR cancel takeProfit %d %+v", openedOrder.TakeProfitOrderId, err)
+		}
+	}
+
+	engine.OpenedOrder = OpenedOrder{}
+	engine.backup()
+	fmt.Printf("Operation:%+v\nFill:%+v\n\n", openedOrder, fill)
+}
+
+// takeProfitExecuted cancels the stop loss of the filled take profit and forgets the opened order
+func (engine *Engine) takeProfitExecuted(fill OrderStatus) {
+	openedOrder := engine.OpenedOrder
+	price := fill.Amount / fill.Quantity
+	color.HiGreen("TAKEPROFIT %d executed %s price:%s quantity:%s",
+		openedOrder.TakeProfitOrderId, openedOrder.Pair, f2s(price), f2s(fill.Quantity),
+	)
+	fees := openedOrder.Fees + orderFee(fill, engine.pairFee(openedOrder.Pair).Maker)
+	engine.Bot.takeProfitExecuted(openedOrder.Pair, price, fill.Quantity, fees, openedOrder.ReplyToMessageID)
+	if openedOrder.StopLossOrderId != 0 {
+		err := engine.wallet(openedOrder).cancelStop(openedOrder.Pair, openedOrder.StopLossOrderId)
+		if err != nil && !errors.Is(err, ErrOrderNotFound) {
+			color.HiRed("ERROR cancel stopLoss %d %+v", openedOrder.StopLossOrderId, err)
+		}
+	}
+
+	engine.OpenedOrder = OpenedOrder{}
+	engine.backup()
+	fmt.Printf("Operation:%+v\nFill:%+v\n\n", openedOrder, fill)
+}
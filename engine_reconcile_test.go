@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestReconcileCancelledStopLoss: a stop cancelled by hand is placed again, the position is not closed
+func TestReconcileCancelledStopLoss(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Long))
+	engine.checkForOpen(engine.Strategies)
+	stopId := engine.OpenedOrder.StopLossOrderId
+	if !engine.isOrderOpened() || stopId == 0 {
+		t.Fatalf("opened order %+v", engine.OpenedOrder)
+	}
+
+	fake.Lock()
+	fake.stopMarketOrderCancel(stopId)
+	fake.Unlock()
+	engine.checkExitOrders()
+
+	if !engine.isOrderOpened() {
+		t.Fatal("the cancelled stop loss is taken for the executed one")
+	}
+	if id := engine.OpenedOrder.StopLossOrderId; id == 0 || id == stopId {
+		t.Errorf("stop loss %d is not placed again", id)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.StopOrders) != 1 || fake.Balance["ETC"] > 1e-6 {
+		t.Errorf("stop orders %d, free coins %f", len(fake.StopOrders), fake.Balance["ETC"])
+	}
+}
+
+// TestReconcileExecutedStopLoss: the stop is found in the trades
+func TestReconcileExecutedStopLoss(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Long))
+	engine.checkForOpen(engine.Strategies)
+	if !engine.isOrderOpened() {
+		t.Fatal("not opened")
+	}
+
+	// the price goes below the stop loss at 80%
+	fake.setCandles("ETC_USDT", hourlyCandles(20, 21, 21, 16))
+	engine.checkExitOrders()
+
+	if engine.isOrderOpened() {
+		t.Fatalf("the executed stop loss is not found %+v", engine.OpenedOrder)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.StopOrders) != 0 || fake.Reserved["ETC"] > 1e-6 || fake.Balance["USDT"] > 1000*0.81 {
+		t.Errorf("stop orders %d, reserved %f, money %f", len(fake.StopOrders), fake.Reserved["ETC"], fake.Balance["USDT"])
+	}
+}
+
+// sendBeforeRestart leaves a market buy of the money in the journal the way a crash after the send does
+func sendBeforeRestart(t *testing.T, exmo *Exmo, fake *FakeExmo, pair string, money float64) {
+	t.Helper()
+	clientId, err := exmo.Orders.add(pair, "market_buy_total", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Lock()
+	response := fake.orderCreate(clientId, pair, "market_buy_total", money, 0)
+	fake.Unlock()
+	if _, failed := response.(fakeError); failed {
+		t.Fatalf("order create %+v", response)
+	}
+	exmo.Orders.checkPending(exmo.findClientOrder)
+}
+
+// TestReconcileAdoptsFoundEntry: the entry sent before the restart becomes the opened order with its stop loss
+func TestReconcileAdoptsFoundEntry(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	sendBeforeRestart(t, exmo, fake, "ETC_USDT", 500)
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Long))
+
+	if !engine.isOrderOpened() {
+		t.Fatal("the found entry is not adopted")
+	}
+	if quantity := engine.OpenedOrder.Quantity; quantity < 23 || quantity > 24 || engine.OpenedOrder.StopLossOrderId == 0 {
+		t.Errorf("quantity %f, stop loss %d", quantity, engine.OpenedOrder.StopLossOrderId)
+	}
+	if found := exmo.foundOrders(); len(found) != 0 {
+		t.Errorf("found orders %d are left", len(found))
+	}
+	if engine.blocked["ETC_USDT"] {
+		t.Error("the adopted pair is blocked")
+	}
+}
+
+// TestReconcileBlocksUnknownEntry: a long bought before the restart has no long strategy, the pair is not opened again
+func TestReconcileBlocksUnknownEntry(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 19, 19)})
+	sendBeforeRestart(t, exmo, fake, "ETC_USDT", 500)
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Short))
+
+	if engine.isOrderOpened() || !engine.blocked["ETC_USDT"] {
+		t.Fatalf("opened %t, blocked %t", engine.isOrderOpened(), engine.blocked["ETC_USDT"])
+	}
+	engine.checkForOpen(engine.Strategies)
+	if engine.isOrderOpened() {
+		t.Errorf("the blocked pair is opened, short %f", engine.OpenedOrder.Quantity)
+	}
+}
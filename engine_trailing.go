@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"github.com/fatih/color"
+)
+
+// trailingStopPrice is the stop loss that follows the price, zero when the strategy has no trailing
+func (engine *Engine) trailingStopPrice(price float64) float64 {
+	trailing := engine.OpenedOrder.Trailing
+	distance := 0.0
+	switch trailing.Type {
+	case TrailingPercent:
+		distance = price * trailing.Value / 100
+	case TrailingAtr:
+		engine.OpenedOrder.updateCandles(func(candleData *CandleData) {
+			distance = trailing.Value * candleData.atr(trailing.Period, candleData.closedIndex())
+		})
+	}
+	if distance <= 0 || distance >= price {
+		return 0
+	}
+
+	if engine.OpenedOrder.isShort() {
+		return price + distance
+	}
+	return price - distance
+}
+
+// trailStopLoss moves the stop loss towards the price, never back, and only by Step or more
+func (engine *Engine) trailStopLoss(price float64) {
+	openedOrder := engine.OpenedOrder
+	stopLossPrice := engine.trailingStopPrice(price)
+	if stopLossPrice == 0 || openedOrder.StopLossOrderId == 0 {
+		return
+	}
+
+	step := float64(openedOrder.Trailing.Step) / 10000
+	if openedOrder.isShort() {
+		if stopLossPrice > openedOrder.StopLossPrice*(1-step) {
+			return
+		}
+	} else if stopLossPrice < openedOrder.StopLossPrice*(1+step) {
+		return
+	}
+
+	pair := openedOrder.Pair
+	err := engine.replaceStopLoss(stopLossPrice)
+	if errors.Is(err, ErrOrderNotFound) {
+		// the stop or the take profit may be executed, checkExitOrders finds it
+		return
+	}
+	if err != nil {
+		// the old price is kept, reconcile places the stop again
+		color.HiRed("ERROR move stopLoss %+v", err)
+		return
+	}
+
+	color.HiBlue("TRAIL %s stopLoss %s -> %s price:%s", pair, f2s(openedOrder.StopLossPrice), f2s(stopLossPrice), f2s(price))
+	engine.Bot.stopLossMoved(pair, openedOrder.StopLossPrice, stopLossPrice, price, openedOrder.ReplyToMessageID)
+}
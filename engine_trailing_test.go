@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// TestTrailingLongStopLoss: the stop keeps the whole position every time it is moved
+func TestTrailingLongStopLoss(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	strategy := testStrategy("ETC_USDT", Long)
+	strategy.Trailing = Trailing{Type: TrailingPercent, Value: 5, Step: 10}
+	engine := newTestEngine(t, exmo, strategy)
+	engine.checkForOpen(engine.Strategies)
+	if !engine.isOrderOpened() {
+		t.Fatal("not opened")
+	}
+	quantity, err := engine.exitQuantity(engine.OpenedOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, price := range []float64{21.2, 21.5} {
+		stopId := engine.OpenedOrder.StopLossOrderId
+		engine.trailStopLoss(price)
+
+		openedOrder := engine.OpenedOrder
+		if openedOrder.StopLossOrderId == 0 || openedOrder.StopLossOrderId == stopId || math.Abs(openedOrder.StopLossPrice-price*0.95) > 1e-9 {
+			t.Fatalf("stop loss %d %f is not moved to %f", openedOrder.StopLossOrderId, openedOrder.StopLossPrice, price*0.95)
+		}
+		fake.Lock()
+		stopOrder := fake.StopOrders[openedOrder.StopLossOrderId]
+		stopOrders := len(fake.StopOrders)
+		fake.Unlock()
+		if stopOrders != 1 || math.Abs(stopOrder.Quantity-quantity) > 1e-8 {
+			t.Errorf("stop orders %d, quantity %f, want %f", stopOrders, stopOrder.Quantity, quantity)
+		}
+	}
+
+	engine.checkExitOrders()
+	if !engine.isOrderOpened() {
+		t.Errorf("the position is closed by the moved stop")
+	}
+}
+
+// TestTrailingShortStopLoss: the resting take profit is placed again after the stop is moved
+func TestTrailingShortStopLoss(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 19, 19)})
+	strategy := testStrategy("ETC_USDT", Short)
+	strategy.Trailing = Trailing{Type: TrailingPercent, Value: 5, Step: 10}
+	engine := newTestEngine(t, exmo, strategy)
+	engine.checkForOpen(engine.Strategies)
+	opened := engine.OpenedOrder
+	if !engine.isOrderOpened() || opened.TakeProfitOrderId == 0 {
+		t.Fatalf("opened %v, take profit %d", engine.isOrderOpened(), opened.TakeProfitOrderId)
+	}
+
+	engine.trailStopLoss(18.9)
+
+	openedOrder := engine.OpenedOrder
+	if openedOrder.StopLossOrderId == opened.StopLossOrderId || math.Abs(openedOrder.StopLossPrice-18.9*1.05) > 1e-9 {
+		t.Errorf("stop loss %d %f is not moved", openedOrder.StopLossOrderId, openedOrder.StopLossPrice)
+	}
+	if openedOrder.TakeProfitOrderId == 0 || openedOrder.TakeProfitPrice != opened.TakeProfitPrice {
+		t.Errorf("take profit %d %f is not placed again", openedOrder.TakeProfitOrderId, openedOrder.TakeProfitPrice)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.Margin.Orders) != 2 {
+		t.Errorf("margin orders %+v", fake.Margin.Orders)
+	}
+	for _, id := range []int64{openedOrder.StopLossOrderId, openedOrder.TakeProfitOrderId} {
+		if _, ok := fake.Margin.Orders[id]; !ok {
+			t.Errorf("order %d is not in the margin book", id)
+		}
+	}
+}
@@ -4,83 +4,111 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha512"
-	"encoding/gob"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/fatih/color"
 	"io/ioutil"
 	"log"
-	"math"
 	"net/http"
 	"net/url"
-	"os"
-	"reflect"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var exmo Exmo
+const exmoBaseUrl = "https://api.exmo.com/v1.1/"
 
-const resolution = "60"
+// exmo allows 10 requests per second from one ip/user
+const exmoRequestsPerSecond = 10
+
+var exmoLimiter = newRateLimiter(exmoRequestsPerSecond, exmoRequestsPerSecond)
 
 type ApiParams map[string]string
 
-func (exmo *Exmo) init() *Exmo {
-	exmo.Key = os.Getenv("exmo.key")
-	exmo.Secret = os.Getenv("exmo.secret")
-	exmo.AvailableDeposit = s2f(os.Getenv("available.deposit"))
-	exmo.apiGetUserInfo()
-	exmo.restore()
+func (exmo *Exmo) init(account *Account) *Exmo {
+	exmo.Account = account.Name
+	exmo.Key = account.env("exmo.key")
+	exmo.Secret = account.env("exmo.secret")
+	exmo.initClient(account.setting("exmo.url"), time.Duration(s2i(account.setting("exmo.timeout")))*time.Second, nil)
+	exmo.initStream(account.setting("exmo.stream"))
+	exmo.Leverage = s2f(account.setting("exmo.leverage"))
+	if _, err := exmo.apiGetUserInfo(); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := exmo.apiGetPairSettings(); err != nil {
+		log.Fatalln(err)
+	}
+	exmo.Orders = newClientOrders(accountFileName(exmo.Account, "exmo_orders.dat"))
+	exmo.Orders.checkPending(exmo.findClientOrder)
 
 	return exmo
 }
 
-func (exmo *Exmo) showBalance() {
-	color.HiYellow("Balance %+v", exmo.Balance)
-}
-
-func (exmo *Exmo) restore() bool {
-	fileName := exmo.getFileName()
-	if !fileExists(fileName) {
-		return false
+// initClient sets the API base url ("fake" starts the bundled fake server), request timeout and transport
+func (exmo *Exmo) initClient(baseUrl string, timeout time.Duration, transport http.RoundTripper) {
+	switch baseUrl {
+	case "":
+		baseUrl = exmoBaseUrl
+	case "fake":
+		exmo.Fake = newFakeExmo()
+		baseUrl = newFakeExmoServer(exmo.Fake).URL + "/v1.1/"
+		color.HiYellow("Fake exmo server: %s", baseUrl)
+	}
+	if !strings.HasSuffix(baseUrl, "/") {
+		baseUrl += "/"
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
 	}
-	dataIn := ReadFromFile(fileName)
-	dec := gob.NewDecoder(bytes.NewReader(dataIn))
-	_ = dec.Decode(&(exmo.OpenedOrder))
 
-	return true
+	exmo.BaseUrl = baseUrl
+	exmo.Client = &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
 }
 
-func (exmo *Exmo) backup() {
-	dataOut := EncodeToBytes(exmo.OpenedOrder)
-	_ = os.WriteFile(exmo.getFileName(), dataOut, 0644)
+func (exmo *Exmo) showBalance() {
+	if exmo.Wallet != nil {
+		color.HiYellow("Balance %s", exmo.Wallet)
+	} else {
+		color.HiYellow("Balance %s", exmo.Balance)
+	}
+	color.HiYellow("Api %s", &exmo.Stats)
+	if exmo.Stream != nil {
+		color.HiYellow("Api %s", exmo.Stream)
+	}
 }
 
 func (exmo *Exmo) getFileName() string {
-	return fmt.Sprintf("exmo.dat")
+	if exmo.Wallet != nil {
+		return accountFileName(exmo.Account, "paper.dat")
+	}
+	return accountFileName(exmo.Account, "exmo.dat")
 }
 
 func (exmo *Exmo) downloadHistoryCandlesForStrategies(strategies []Strategy) {
 	for _, strategy := range strategies {
-		candleData := strategy.getCandleData()
-		candleData.Candles = make(map[BarType][]float64)
-		exmo.downloadPairCandles(candleData)
+		strategy.updateCandles(exmo.downloadPairCandles)
 	}
 }
 
 func (exmo *Exmo) downloadPairCandles(candleData *CandleData) {
 	endDate := time.Now().Unix()
-	startDate := time.Now().AddDate(0, -2, 0).Unix()
+	startDate := candleData.restoreHistory().Unix()
 
 	for startDate < endDate {
 		from := startDate
-		to := startDate + 125*3600
+		to := startDate + 125*candleData.Resolution.seconds()
 
-		candleHistory := exmo.apiGetCandles(candleData.Pair, resolution, from, to)
+		candleHistory, err := exmo.apiGetCandles(candleData.Pair, candleData.Resolution, from, to)
 
 		startDate = to
 
+		if err != nil {
+			color.HiRed("ERROR candles %s %+v", candleData.Pair, err)
+			continue
+		}
 		if candleHistory.isEmpty() {
 			continue
 		}
@@ -95,266 +123,502 @@ func (exmo *Exmo) downloadPairCandles(candleData *CandleData) {
 	}
 	fmt.Printf("Кол-во свечей: %d\n", candleData.len())
 
+	candleData.fillGaps(exmo.candlesDownloader(candleData))
 	candleData.fillIndicators()
-	candleData.save()
+	candleData.backup()
+}
+
+// candlesDownloader requests the missing candles of a gap
+func (exmo *Exmo) candlesDownloader(candleData *CandleData) func(from, to time.Time) []Candle {
+	return func(from, to time.Time) []Candle {
+		candleHistory, err := exmo.apiGetCandles(candleData.Pair, candleData.Resolution, from.Unix(), to.Unix())
+		if err != nil {
+			color.HiRed("ERROR candles %s %+v", candleData.Pair, err)
+			return nil
+		}
+		var candles []Candle
+		for _, c := range candleHistory.Candles {
+			candles = append(candles, c.transform())
+		}
+		return candles
+	}
 }
 
 func (exmo *Exmo) downloadNewCandleForStrategies(strategies []Strategy) {
 	for _, strategy := range strategies {
-		candle := exmo.downloadNewCandle(-1, strategy.Pair)
+		candle := exmo.downloadNewCandle(-1, strategy.Pair, strategy.Resolution)
 
 		if !candle.isEmpty() {
-			candleData := strategy.getCandleData()
-			candleData.upsertCandle(candle)
-			candleData.save()
+			strategy.updateCandles(func(candleData *CandleData) {
+				// the history failed to download at the start, it is requested again instead of the one candle
+				if candleData.len() == 0 {
+					exmo.downloadPairCandles(candleData)
+					return
+				}
+				candleData.upsertCandle(candle)
+				candleData.fillGaps(exmo.candlesDownloader(candleData))
+				candleData.backup()
+			})
+
+			if exmo.Wallet != nil {
+				exmo.Wallet.triggerOrders(strategy.Pair, candle)
+			}
 		}
 	}
 }
 
-func (exmo *Exmo) downloadNewCandle(index int64, pair string) Candle {
-	dt := ((time.Now().Unix() / 3600) + index) * 3600
+func (exmo *Exmo) downloadNewCandle(index int64, pair string, resolution Resolution) Candle {
+	step := resolution.seconds()
+	dt := ((time.Now().Unix() / step) + index) * step
 
-	var candleHistory ExmoCandleHistoryResponse
 	for i := 1; i <= 50; i++ {
-		candleHistory = exmo.apiGetCandles(pair, resolution, dt, dt)
-		if !candleHistory.isEmpty() {
+		candleHistory, err := exmo.apiGetCandles(pair, resolution, dt, dt)
+		if err != nil {
+			color.HiRed("ERROR candle %s %+v", pair, err)
+		} else if !candleHistory.isEmpty() {
 			return candleHistory.Candles[0].transform()
 		}
+		time.Sleep(time.Second)
 	}
 
 	return Candle{}
 }
 
-func (exmo *Exmo) listenCandles(strategies []Strategy) {
-	_, _ = scheduler.Cron("0 * * * *").Do(exmo.checkOperation, strategies)
+func (exmo *Exmo) listenPrices(strategies []Strategy, onTick func(pair string, price, quantity float64, t time.Time, isTrade bool)) {
+	if exmo.Stream != nil {
+		go exmo.Stream.run(exmo.streamTopics(strategies), func(event ExmoWsEvent) {
+			exmo.onStreamUpdate(event, onTick)
+		})
+	}
 }
 
-func (exmo *Exmo) checkOperation(strategies []Strategy) {
-	time.Sleep(time.Second * 1)
-	color.HiBlue("%s\n", time.Now().Format("02.01.06 15:04:05"))
-	exmo.downloadNewCandleForStrategies(getUniqueStrategies(strategies))
-	if exmo.isOrderOpened() {
-		exmo.checkForClose()
-	} else {
-		exmo.checkForOpen(strategies)
+func (exmo *Exmo) apiGetCandles(symbol string, resolution Resolution, from, to int64) (ExmoCandleHistoryResponse, error) {
+	params := ApiParams{
+		"symbol":     symbol,
+		"resolution": string(resolution),
+		"from":       i2s(from),
+		"to":         i2s(to),
 	}
-}
 
-func (exmo *Exmo) checkForOpen(strategies []Strategy) {
-	exmo.apiGetUserInfo()
+	var candleHistory ExmoCandleHistoryResponse
+	err := exmo.apiCall("candles_history", params, &candleHistory)
 
-	for _, strategy := range strategies {
-		candleData := strategy.getCandleData()
-
-		index := candleData.index()
-		v1 := candleData.fillIndicator(index, strategy.Ind1)
-		v2 := candleData.fillIndicator(index, strategy.Ind2)
-		candleData.save()
-
-		percentsForOpen := 10000 * v1 / v2 / float64(10000+strategy.Op)
-		if percentsForOpen > 1.0 {
-			pair := strategy.Pair
-			candle := exmo.downloadNewCandle(0, pair)
-			if candle.isEmpty() {
-				continue
-			}
-			money := exmo.getCurrencyBalance(getRightCurrency(pair)) * exmo.AvailableDeposit
-			buyOrder := exmo.apiBuy(pair, money)
-			if buyOrder.isSuccess() {
-				openedOrder := OpenedOrder{
-					Strategy:    strategy,
-					OpenedPrice: candle.O,
-				}
-				color.HiGreen("SUCCESS order open->")
-
-				// выставляем стоп лосс
-				exmo.apiGetUserInfo()
-				quantity := exmo.getCurrencyBalance(getLeftCurrency(pair))
-				stopLossPrice := candle.O * 0.8
-				stopLossOrder := exmo.apiSetStopLoss(pair, quantity, stopLossPrice)
-				if stopLossOrder.isSuccess() {
-					openedOrder.StopLossOrderId = stopLossOrder.ParentOrderID
-				} else {
-					color.HiRed("ERROR set stopLoss %+v", stopLossOrder)
-				}
+	return candleHistory, err
+}
 
-				takeProfit := candle.O * float64(10000+strategy.Tp) / 10000
-				screen := candleData.drawBars(takeProfit, stopLossPrice)
-				openedOrder.ReplyToMessageID = tgBot.newOrderOpened(pair, candle.O, stopLossPrice, screen)
+// apiBuy spends money of the right currency, price is used to validate the order against pair settings
+// and paper orders are filled at it
+func (exmo *Exmo) apiBuy(pair string, money, price float64) (OrderResponse, error) {
+	settings, err := exmo.getPairSettings(pair)
+	if err != nil {
+		return OrderResponse{}, err
+	}
+	money = settings.roundAmount(money)
+	if err = settings.check(pair, money/price, price); err != nil {
+		return OrderResponse{}, err
+	}
 
-				exmo.OpenedOrder = openedOrder
-				exmo.backup()
-			} else {
-				color.HiRed("ERROR order open->")
-			}
-			fmt.Printf("OpenedOrder:%+v\nOrder:%+v\n\n", exmo.OpenedOrder, buyOrder)
-		} else {
-			fmt.Printf("%.4f strategy:%+v v1:%f v2:%f\n", percentsForOpen, strategy, v1, v2)
-		}
+	params := ApiParams{
+		"pair":     pair,
+		"quantity": formatFloat(money, exmoQuantityPrecision),
+		"price":    "0",
+		"type":     "market_buy_total",
 	}
+
+	return exmo.apiCreateOrder(params, price)
 }
 
-func (exmo *Exmo) checkForClose() {
-	openedOrder := exmo.OpenedOrder
-	pair := openedOrder.Pair
-	candle := exmo.downloadNewCandle(0, pair)
-	if candle.isEmpty() {
-		time.Sleep(time.Second * 30)
-		candle = exmo.downloadNewCandle(0, pair)
-		if candle.isEmpty() {
-			return
-		}
+// apiLimitOrder places a "buy" or "sell" limit order, it stays in the order book until filled or cancelled
+func (exmo *Exmo) apiLimitOrder(pair, orderType string, quantity, price float64) (OrderResponse, error) {
+	settings, err := exmo.getPairSettings(pair)
+	if err != nil {
+		return OrderResponse{}, err
 	}
-	percentsToClose := candle.O * 10000 / openedOrder.OpenedPrice / float64(10000+openedOrder.Tp)
-	fmt.Printf("Percents to close: %f\n", percentsToClose)
-	if percentsToClose >= 1.0 {
-		exmo.apiCancelStopLoss(exmo.OpenedOrder.StopLossOrderId)
-		exmo.OpenedOrder.StopLossOrderId = 0
-
-		exmo.apiGetUserInfo()
-		quantity := exmo.getCurrencyBalance(getLeftCurrency(pair))
-		order := exmo.apiClose(pair, quantity)
-
-		if order.isSuccess() {
-			color.HiGreen("SUCCESS order close->")
-			tgBot.orderClosed(pair, candle.O, exmo.OpenedOrder.ReplyToMessageID)
-			exmo.OpenedOrder = OpenedOrder{}
-			exmo.backup()
-		} else {
-			color.HiRed("ERROR order close->")
-		}
-		fmt.Printf("Operation:%+v\nOrder:%+v\n\n", openedOrder, order)
+	quantity = settings.roundQuantity(quantity)
+	price = settings.roundPrice(price)
+	if err = settings.check(pair, quantity, price); err != nil {
+		return OrderResponse{}, err
+	}
+
+	params := ApiParams{
+		"pair":     pair,
+		"quantity": formatFloat(quantity, exmoQuantityPrecision),
+		"price":    formatFloat(price, settings.PricePrecision),
+		"type":     orderType,
 	}
+
+	return exmo.apiCreateOrder(params, 0)
 }
 
-func (exmo *Exmo) apiGetCandles(symbol, resolution string, from, to int64) ExmoCandleHistoryResponse {
+func (exmo *Exmo) apiCancelOrder(orderId int64) error {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.cancelOrder(orderId)
+	}
+
 	params := ApiParams{
-		"symbol":     symbol,
-		"resolution": resolution,
-		"from":       i2s(from),
-		"to":         i2s(to),
+		"order_id": i2s(orderId),
 	}
 
-	bts, err := exmo.apiQuery("candles_history", params)
+	return exmo.apiCall("order_cancel", params, nil)
+}
 
-	var candleHistory ExmoCandleHistoryResponse
-	err = json.Unmarshal(bts, &candleHistory)
+// apiGetOrderTrades returns no trades for orders that were not filled yet
+func (exmo *Exmo) apiGetOrderTrades(orderId int64) (OrderTradesResponse, error) {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.orderTrades(orderId), nil
+	}
 
-	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
+	params := ApiParams{
+		"order_id": i2s(orderId),
+	}
+
+	var response OrderTradesResponse
+	err := exmo.apiCall("order_trades", params, &response)
+	if isExmoErrorCode(err, ExmoErrorOrderNotFound) {
+		err = nil
 	}
 
-	return candleHistory
+	return response, err
 }
 
-func (exmo *Exmo) apiBuy(pair string, money float64) OrderResponse {
+func (exmo *Exmo) apiGetOrderBook(pair string) (OrderBook, error) {
 	params := ApiParams{
-		"pair":     pair,
-		"quantity": f2s(money),
-		"price":    "0",
-		"type":     "market_buy_total",
+		"pair":  pair,
+		"limit": "1",
 	}
 
-	return exmo.apiCreateOrder(params)
+	var response OrderBookResponse
+	if err := exmo.apiCall("order_book", params, &response); err != nil {
+		return OrderBook{}, err
+	}
+	book, ok := response[pair]
+	if !ok || book.BidTop <= 0 {
+		return book, &ExmoError{Method: "order_book", Message: "empty order book " + pair}
+	}
+
+	return book, nil
 }
 
-func (exmo *Exmo) apiSetStopLoss(pair string, coins float64, price float64) StopOrderResponse {
-	const decimals = 100000000
+// apiSetStopLoss places a stop market order, orderType is "sell" for longs and "buy" for shorts
+func (exmo *Exmo) apiSetStopLoss(pair, orderType string, coins float64, price float64) (StopOrderResponse, error) {
+	settings, err := exmo.getPairSettings(pair)
+	if err != nil {
+		return StopOrderResponse{}, err
+	}
+	coins = settings.roundQuantity(coins)
+	price = settings.roundPrice(price)
+	if err = settings.check(pair, coins, price); err != nil {
+		return StopOrderResponse{}, err
+	}
+
+	if exmo.Wallet != nil {
+		return exmo.Wallet.createStopLoss(pair, orderType, coins, price)
+	}
 
 	params := ApiParams{
 		"pair":          pair,
-		"quantity":      f2s(coins),
-		"trigger_price": f2s(math.Round(price*decimals) / decimals),
-		"type":          "sell",
+		"quantity":      formatFloat(coins, exmoQuantityPrecision),
+		"trigger_price": formatFloat(price, settings.PricePrecision),
+		"type":          orderType,
 	}
-	bts, err := exmo.apiQuery("stop_market_order_create", params)
 
 	var response StopOrderResponse
-	err = json.Unmarshal(bts, &response)
-
-	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
+	err = exmo.apiCreate("stop_market_order_create", params, &response, func(orderId int64) {
+		response.ParentOrderID = orderId
+	})
+	if err == nil && response.ParentOrderID == 0 {
+		err = &ExmoError{Method: "stop_market_order_create", Message: "empty parent_order_id"}
 	}
 
-	return response
+	return response, err
 }
 
-func (exmo *Exmo) apiCancelStopLoss(parentOrderId int64) {
+func (exmo *Exmo) apiCancelStopLoss(parentOrderId int64) error {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.cancelStopLoss(parentOrderId)
+	}
+
 	params := ApiParams{
 		"parent_order_id": i2s(parentOrderId),
 	}
-	_, err := exmo.apiQuery("stop_market_order_cancel", params)
 
-	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
-	}
+	return exmo.apiCall("stop_market_order_cancel", params, nil)
 }
 
-func (exmo *Exmo) apiCreateOrder(params ApiParams) OrderResponse {
-	bts, err := exmo.apiQuery("order_create", params)
+// apiCreateOrder: price is the market price the caller saw, paper market orders are filled at it.
+// Limit orders pass 0, the paper wallet compares their price with the last trade then
+func (exmo *Exmo) apiCreateOrder(params ApiParams, price float64) (OrderResponse, error) {
+	if exmo.Wallet != nil {
+		if price <= 0 {
+			price = exmo.lastPrice(params["pair"])
+		}
+		return exmo.Wallet.createOrder(params, price)
+	}
 
 	var response OrderResponse
-	err = json.Unmarshal(bts, &response)
+	err := exmo.apiCreate("order_create", params, &response, func(orderId int64) {
+		response = OrderResponse{Result: true, OrderID: int(orderId)}
+	})
+
+	return response, err
+}
 
+// lastPrice is the close of the last minute candle, 0 when nothing was traded for 10 minutes
+func (exmo *Exmo) lastPrice(pair string) float64 {
+	now := time.Now().Unix()
+	candleHistory, err := exmo.apiGetCandles(pair, "1", now-10*60, now)
 	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
+		color.HiRed("ERROR last price %s %+v", pair, err)
+		return 0
 	}
-
-	return response
+	if candleHistory.isEmpty() {
+		return 0
+	}
+	return candleHistory.Candles[len(candleHistory.Candles)-1].C
 }
 
-func (exmo *Exmo) apiClose(symbol string, quantity float64) OrderResponse {
+func (exmo *Exmo) apiClose(symbol string, quantity, price float64) (OrderResponse, error) {
+	settings, err := exmo.getPairSettings(symbol)
+	if err != nil {
+		return OrderResponse{}, err
+	}
+	quantity = settings.roundQuantity(quantity)
+	if err = settings.check(symbol, quantity, price); err != nil {
+		return OrderResponse{}, err
+	}
+
 	params := ApiParams{
 		"pair":     symbol,
-		"quantity": f2s(quantity),
+		"quantity": formatFloat(quantity, exmoQuantityPrecision),
 		"price":    "0",
 		"type":     "market_sell",
 	}
 
-	bts, err := exmo.apiQuery("order_create", params)
-
-	var response OrderResponse
-	err = json.Unmarshal(bts, &response)
+	return exmo.apiCreateOrder(params, price)
+}
 
+// apiMarketBuy buys the quantity of coins, price is used to validate the order against pair settings
+// and paper orders are filled at it
+func (exmo *Exmo) apiMarketBuy(pair string, quantity, price float64) (OrderResponse, error) {
+	settings, err := exmo.getPairSettings(pair)
 	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
+		return OrderResponse{}, err
+	}
+	quantity = settings.roundQuantity(quantity)
+	if err = settings.check(pair, quantity, price); err != nil {
+		return OrderResponse{}, err
+	}
+
+	params := ApiParams{
+		"pair":     pair,
+		"quantity": formatFloat(quantity, exmoQuantityPrecision),
+		"price":    "0",
+		"type":     "market_buy",
+	}
+
+	return exmo.apiCreateOrder(params, price)
+}
+
+func (exmo *Exmo) apiGetPairSettings() (PairSettingsResponse, error) {
+	var response PairSettingsResponse
+	if err := exmo.apiCall("pair_settings", ApiParams{}, &response); err != nil {
+		return response, err
+	}
+
+	exmo.PairSettings = response
+
+	return response, nil
+}
+
+// getPairSettings reloads the cached settings once when the pair is unknown
+func (exmo *Exmo) getPairSettings(pair string) (PairSettings, error) {
+	settings, ok := exmo.PairSettings[pair]
+	if ok {
+		return settings, nil
 	}
 
-	return response
+	if _, err := exmo.apiGetPairSettings(); err != nil {
+		return settings, err
+	}
+	if settings, ok = exmo.PairSettings[pair]; !ok {
+		return settings, &OrderRejectedError{Pair: pair, Reason: "unknown pair"}
+	}
+	return settings, nil
 }
 
-func (exmo *Exmo) apiGetUserInfo() UserInfoResponse {
-	params := ApiParams{}
+func (exmo *Exmo) apiGetOpenOrders() (OpenOrdersResponse, error) {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.openOrders(), nil
+	}
+
+	var response OpenOrdersResponse
+	err := exmo.apiCall("user_open_orders", ApiParams{}, &response)
 
-	bts, err := exmo.apiQuery("user_info", params)
+	return response, err
+}
+
+func (exmo *Exmo) apiGetUserTrades(pair string, limit int) (UserTradesResponse, error) {
+	if exmo.Wallet != nil {
+		return UserTradesResponse{pair: exmo.Wallet.trades(pair, limit)}, nil
+	}
+
+	params := ApiParams{
+		"pair":   pair,
+		"limit":  strconv.Itoa(limit),
+		"offset": "0",
+	}
+
+	var response UserTradesResponse
+	err := exmo.apiCall("user_trades", params, &response)
+
+	return response, err
+}
+
+func (exmo *Exmo) apiGetUserInfo() (UserInfoResponse, error) {
+	if exmo.Wallet != nil {
+		return UserInfoResponse{}, nil
+	}
 
 	var response UserInfoResponse
-	err = json.Unmarshal(bts, &response)
+	if err := exmo.apiCall("user_info", ApiParams{}, &response); err != nil {
+		return response, err
+	}
+
+	exmo.Balance = newBalances(response.Balances, response.Reserved)
 
+	return response, nil
+}
+
+func (exmo *Exmo) getCurrencyBalance(symbol Currency) float64 {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.Balance.available(symbol)
+	}
+
+	return exmo.Balance.available(symbol)
+}
+
+// apiCall queries the method and decodes the response into result, error envelopes are returned as *ExmoError
+func (exmo *Exmo) apiCall(method string, params ApiParams, result interface{}) error {
+	bts, err := exmo.apiQuery(method, params)
 	if err != nil {
-		fmt.Sprintln(err)
-		log.Fatalln(err)
+		return fmt.Errorf("%s: %w", method, err)
+	}
+
+	if err = parseExmoError(method, bts); err != nil {
+		return err
 	}
 
-	exmo.Balance = response.Balances
+	if result == nil {
+		return nil
+	}
+	if err = json.Unmarshal(bts, result); err != nil {
+		return &ExmoError{Method: method, Message: "decode: " + err.Error()}
+	}
 
-	return response
+	return nil
 }
 
-func (exmo *Exmo) getCurrencyBalance(symbol Currency) float64 {
-	r := reflect.ValueOf(exmo.Balance)
-	f := reflect.Indirect(r).FieldByName(string(symbol))
-	return f.Float()
+// apiCreate sends an order tagged with a client id saved before sending. An attempt after a failed one
+// first looks for the order by the id, so an order accepted by exchange with the response lost is not placed twice
+func (exmo *Exmo) apiCreate(method string, params ApiParams, result interface{}, onFound func(orderId int64)) error {
+	margin := strings.HasPrefix(method, "margin/")
+	clientId, err := exmo.Orders.add(params["pair"], params["type"], margin)
+	if err != nil {
+		return err
+	}
+	params["client_id"] = i2s(clientId)
+	order := ClientOrder{Id: clientId, Pair: params["pair"], Type: params["type"], Margin: margin}
+
+	sent := false
+	find := func() (bool, error) {
+		orderId, found, err := exmo.findClientOrder(order)
+		if found {
+			color.HiYellow("ORDER %d of client id %d is found after the failure", orderId, clientId)
+			onFound(orderId)
+		}
+		return found, err
+	}
+	err = defaultBackoff.retry(exmoLimiter, &exmo.Stats, method, func() error {
+		if sent {
+			if found, err := find(); found || err != nil {
+				return err
+			}
+		}
+		sent = true
+		bts, err := exmo.apiRequest(method, params)
+		if err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+		if err = parseExmoError(method, bts); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(bts, result); err != nil {
+			return &ExmoError{Method: method, Message: "decode: " + err.Error()}
+		}
+		return nil
+	})
+	if err != nil && isRetryable(err) {
+		if found, findErr := find(); found {
+			err = nil
+		} else if findErr != nil {
+			// still unknown, the journal keeps the order until the next start
+			return err
+		}
+	}
+	exmo.Orders.done(clientId)
+
+	return err
+}
+
+// findClientOrder looks for the order in the open orders and the last trades of the pair,
+// stop orders are found by the parent order id
+func (exmo *Exmo) findClientOrder(order ClientOrder) (int64, bool, error) {
+	if order.Margin {
+		return exmo.findMarginClientOrder(order)
+	}
+	openOrders, err := exmo.apiGetOpenOrders()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, openOrder := range openOrders[order.Pair] {
+		if openOrder.ClientID != order.Id {
+			continue
+		}
+		if openOrder.ParentOrderID != 0 {
+			return openOrder.ParentOrderID, true, nil
+		}
+		return openOrder.OrderID, true, nil
+	}
+
+	trades, err := exmo.apiGetUserTrades(order.Pair, 100)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, trade := range trades[order.Pair] {
+		if trade.ClientID != order.Id {
+			continue
+		}
+		if trade.ParentOrderID != 0 {
+			return trade.ParentOrderID, true, nil
+		}
+		return trade.OrderID, true, nil
+	}
+
+	return 0, false, nil
 }
 
 func (exmo *Exmo) apiQuery(method string, params ApiParams) ([]byte, error) {
-	time.Sleep(time.Millisecond * 50)
+	var bts []byte
+	err := defaultBackoff.retry(exmoLimiter, &exmo.Stats, method, func() error {
+		var err error
+		bts, err = exmo.apiRequest(method, params)
+		return err
+	})
+
+	return bts, err
+}
 
+func (exmo *Exmo) apiRequest(method string, params ApiParams) ([]byte, error) {
 	postParams := url.Values{}
 	postParams.Add("nonce", nonce())
 	if params != nil {
@@ -366,30 +630,25 @@ func (exmo *Exmo) apiQuery(method string, params ApiParams) ([]byte, error) {
 
 	sign := doSign(postContent, exmo.Secret)
 
-	req, _ := http.NewRequest("POST", "https://api.exmo.com/v1.1/"+method, bytes.NewBuffer([]byte(postContent)))
+	req, _ := http.NewRequest("POST", exmo.BaseUrl+method, bytes.NewBuffer([]byte(postContent)))
 	req.Header.Set("Key", exmo.Key)
 	req.Header.Set("Sign", sign)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Content-Length", strconv.Itoa(len(postContent)))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := exmo.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.Status != "200 OK" {
-		return nil, errors.New("http status: " + resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HttpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	return ioutil.ReadAll(resp.Body)
 }
 
-func (exmo *Exmo) isOrderOpened() bool {
-	return exmo.OpenedOrder.isEmpty() == false
-}
-
 func nonce() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
@@ -0,0 +1,125 @@
+package main
+
+// the methods below implement the order primitives of ApiInterface on top of the exmo api
+
+func (exmo *Exmo) String() string {
+	return "exmo " + exmo.Stats.String()
+}
+
+// foundOrders: paper trading has no client orders
+func (exmo *Exmo) foundOrders() []ClientOrder {
+	if exmo.Orders == nil {
+		return nil
+	}
+	return exmo.Orders.takeFound()
+}
+
+func (exmo *Exmo) getBalances() (Balances, error) {
+	if exmo.Wallet != nil {
+		return exmo.Wallet.Balance, nil
+	}
+	if _, err := exmo.apiGetUserInfo(); err != nil {
+		return nil, err
+	}
+	return exmo.Balance, nil
+}
+
+func (exmo *Exmo) getPairInfo(pair string) (PairInfo, error) {
+	settings, err := exmo.getPairSettings(pair)
+	if err != nil {
+		return PairInfo{}, err
+	}
+	return PairInfo{
+		MinQuantity:       settings.MinQuantity,
+		QuantityPrecision: exmoQuantityPrecision,
+		TakerFee:          settings.CommissionTakerPercent / 100,
+		MakerFee:          settings.CommissionMakerPercent / 100,
+	}, nil
+}
+
+func (exmo *Exmo) getBestBid(pair string) (float64, error) {
+	book, err := exmo.apiGetOrderBook(pair)
+	return book.BidTop, err
+}
+
+func (exmo *Exmo) marketBuyTotal(pair string, money, price float64) (int64, error) {
+	order, err := exmo.apiBuy(pair, money, price)
+	return int64(order.OrderID), err
+}
+
+func (exmo *Exmo) placeMarketOrder(pair, side string, quantity, price float64) (int64, error) {
+	var order OrderResponse
+	var err error
+	if side == "buy" {
+		order, err = exmo.apiMarketBuy(pair, quantity, price)
+	} else {
+		order, err = exmo.apiClose(pair, quantity, price)
+	}
+	return int64(order.OrderID), err
+}
+
+func (exmo *Exmo) placeLimitOrder(pair, side string, quantity, price float64) (int64, error) {
+	order, err := exmo.apiLimitOrder(pair, side, quantity, price)
+	return int64(order.OrderID), err
+}
+
+func (exmo *Exmo) cancelOrder(pair string, orderId int64) error {
+	return exmo.apiCancelOrder(orderId)
+}
+
+// getOrderStatus: an order is open while it is in the order book, the filled part comes from its trades
+func (exmo *Exmo) getOrderStatus(pair string, orderId int64) (OrderStatus, error) {
+	openOrders, err := exmo.apiGetOpenOrders()
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	trades, err := exmo.apiGetOrderTrades(orderId)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+
+	status := OrderStatus{Open: openOrders.contains(pair, orderId)}
+	status.Quantity, status.Amount, status.Fee = trades.fill()
+
+	return status, nil
+}
+
+func (exmo *Exmo) placeStop(pair, side string, quantity, triggerPrice float64) (int64, error) {
+	order, err := exmo.apiSetStopLoss(pair, side, quantity, triggerPrice)
+	return order.ParentOrderID, err
+}
+
+func (exmo *Exmo) cancelStop(pair string, stopId int64) error {
+	return exmo.apiCancelStopLoss(stopId)
+}
+
+func (exmo *Exmo) getStopOrders(pair string) ([]StopOrder, error) {
+	openOrders, err := exmo.apiGetOpenOrders()
+	if err != nil {
+		return nil, err
+	}
+
+	var stopOrders []StopOrder
+	for _, order := range openOrders.stopOrders(pair) {
+		stopOrders = append(stopOrders, StopOrder{
+			Id:           order.ParentOrderID,
+			Side:         order.Type,
+			Quantity:     order.Quantity,
+			TriggerPrice: order.TriggerPrice,
+		})
+	}
+	return stopOrders, nil
+}
+
+func (exmo *Exmo) getTrades(pair string, limit int) ([]Trade, error) {
+	response, err := exmo.apiGetUserTrades(pair, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var trades []Trade
+	for _, trade := range response[pair] {
+		trades = append(trades, trade.transform())
+	}
+	return trades, nil
+}
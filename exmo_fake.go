@@ -0,0 +1,749 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeExmo is an in-memory stand-in for the Exmo REST API. It is a part of the bot on purpose: "exmo.url=fake"
+// runs the whole bot offline, the tests drive the same server through setCandles and DropResponses.
+// Like on exmo the limit orders and the sell stops move their money or coins from Balance to Reserved
+type FakeExmo struct {
+	sync.Mutex
+	Secret      string
+	Balance     map[Currency]float64
+	Reserved    map[Currency]float64
+	Candles     map[string][]ExmoCandle
+	StopOrders  map[int64]FakeStopOrder
+	Orders      map[int64]FakeOrder
+	Trades      map[string][]ExmoTrade
+	Settings    PairSettingsResponse
+	Fee         float64
+	LastOrderId int64
+	// Margin is the margin wallet, its money is apart from the spot one
+	Margin        *MarginBook
+	MarginBalance Balances
+	// DropResponses is the number of next requests that are executed but lose the response
+	DropResponses int
+}
+
+// FakeOrder is a limit order waiting in the order book, it reserves the money of a buy and the coins of a sell
+type FakeOrder struct {
+	ClientId int64
+	Pair     string
+	Type     string
+	Quantity float64
+	Price    float64
+	Created  int64
+}
+
+type FakeStopOrder struct {
+	ClientId     int64
+	Pair         string
+	Quantity     float64
+	TriggerPrice float64
+	Type         string
+}
+
+func newFakeExmo() *FakeExmo {
+	return &FakeExmo{
+		Balance:    map[Currency]float64{"USDT": 1000},
+		Reserved:   make(map[Currency]float64),
+		Candles:    make(map[string][]ExmoCandle),
+		StopOrders: make(map[int64]FakeStopOrder),
+		Orders:     make(map[int64]FakeOrder),
+		Trades:     make(map[string][]ExmoTrade),
+		Settings:   make(PairSettingsResponse),
+		// the same as the commission in the pair settings
+		Fee:           0.003,
+		Margin:        newMarginBook(),
+		MarginBalance: Balances{"USDT": {Available: 1000}},
+	}
+}
+
+func newFakeExmoServer(fake *FakeExmo) *httptest.Server {
+	return httptest.NewServer(fake)
+}
+
+// setCandles replaces the candle history of the pair, candles are kept sorted by time
+func (fake *FakeExmo) setCandles(pair string, candles []ExmoCandle) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	sort.Slice(candles, func(i, j int) bool { return candles[i].T < candles[j].T })
+	fake.Candles[pair] = candles
+}
+
+// generateCandles builds hourly candles for the last months so that unknown pairs have some history
+func (fake *FakeExmo) generateCandles(pair string) []ExmoCandle {
+	var candles []ExmoCandle
+	end := time.Now().Unix() / 3600 * 3600
+	start := time.Now().AddDate(0, -3, 0).Unix() / 3600 * 3600
+	for t := start; t <= end; t += 3600 {
+		i := float64((t - start) / 3600)
+		o := 20 + 2*math.Sin(i/24) + math.Sin(i/5)
+		c := 20 + 2*math.Sin((i+1)/24) + math.Sin((i+1)/5)
+		candles = append(candles, ExmoCandle{
+			T: t * 1000,
+			O: o,
+			C: c,
+			H: math.Max(o, c) * 1.005,
+			L: math.Min(o, c) * 0.995,
+			V: 1000 + 500*math.Sin(i/7),
+		})
+	}
+	fake.Candles[pair] = candles
+	return candles
+}
+
+func (fake *FakeExmo) candles(pair string) []ExmoCandle {
+	candles, ok := fake.Candles[pair]
+	if !ok {
+		candles = fake.generateCandles(pair)
+	}
+	return candles
+}
+
+// price is the close of the last candle that already started
+func (fake *FakeExmo) price(pair string) float64 {
+	now := time.Now().Unix() * 1000
+	price := 0.0
+	for _, c := range fake.candles(pair) {
+		if c.T > now {
+			break
+		}
+		price = c.C
+	}
+	return price
+}
+
+func (fake *FakeExmo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+
+	fake.Lock()
+	defer fake.Unlock()
+
+	if fake.Secret != "" && r.Header.Get("Sign") != doSign(r.PostForm.Encode(), fake.Secret) {
+		fake.writeError(w, 40005, "Authorization error, incorrect signature")
+		return
+	}
+
+	fake.triggerStopOrders()
+	fake.fillOrders()
+	fake.triggerMarginOrders()
+
+	var response interface{}
+	switch method := strings.TrimPrefix(r.URL.Path, "/v1.1/"); method {
+	case "candles_history":
+		response = fake.candlesHistory(r.Form.Get("symbol"), Resolution(r.Form.Get("resolution")), s2i(r.Form.Get("from")), s2i(r.Form.Get("to")))
+	case "pair_settings":
+		response = fake.pairSettings()
+	case "user_info":
+		response = fake.userInfo()
+	case "order_create":
+		response = fake.orderCreate(s2i(r.Form.Get("client_id")), r.Form.Get("pair"), r.Form.Get("type"), s2f(r.Form.Get("quantity")), s2f(r.Form.Get("price")))
+	case "order_cancel":
+		response = fake.orderCancel(s2i(r.Form.Get("order_id")))
+	case "order_trades":
+		response = fake.orderTrades(s2i(r.Form.Get("order_id")))
+	case "order_book":
+		response = fake.orderBook(r.Form.Get("pair"))
+	case "stop_market_order_create":
+		response = fake.stopMarketOrderCreate(s2i(r.Form.Get("client_id")), r.Form.Get("pair"), r.Form.Get("type"), s2f(r.Form.Get("quantity")), s2f(r.Form.Get("trigger_price")))
+	case "stop_market_order_cancel":
+		response = fake.stopMarketOrderCancel(s2i(r.Form.Get("parent_order_id")))
+	case "margin/user/order/create":
+		response = fake.marginOrderCreate(r.Form)
+	case "margin/user/order/cancel":
+		response = fake.marginOrderCancel(s2i(r.Form.Get("order_id")))
+	case "margin/user/order/list":
+		response = MarginOrdersResponse{Orders: fake.Margin.openOrders()}
+	case "margin/user/trades":
+		response = MarginTradesResponse{Trades: fake.Margin.trades(r.Form.Get("pair"), int(s2i(r.Form.Get("limit"))))}
+	case "margin/user/wallet/list":
+		response = fake.marginWallet()
+	case "user_open_orders":
+		response = fake.userOpenOrders()
+	case "user_trades":
+		response = fake.userTrades(r.Form.Get("pair"), int(s2i(r.Form.Get("limit"))))
+	default:
+		fake.writeError(w, 40015, "API function do not exist: "+method)
+		return
+	}
+
+	if fake.DropResponses > 0 {
+		fake.DropResponses--
+		// the request is done, the client sees a broken connection
+		panic(http.ErrAbortHandler)
+	}
+	if err, ok := response.(fakeError); ok {
+		fake.writeError(w, err.code, err.message)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+type fakeError struct {
+	code    int
+	message string
+}
+
+func (fake *FakeExmo) writeError(w http.ResponseWriter, code int, message string) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": false,
+		"error":  fmt.Sprintf("Error %d: %s", code, message),
+	})
+}
+
+func (fake *FakeExmo) candlesHistory(pair string, resolution Resolution, from, to int64) interface{} {
+	response := ExmoCandleHistoryResponse{S: "ok", Candles: []ExmoCandle{}}
+	for _, c := range resampleCandles(fake.candles(pair), resolution) {
+		if c.T >= from*1000 && c.T <= to*1000 {
+			response.Candles = append(response.Candles, c)
+		}
+	}
+	return response
+}
+
+// resampleCandles merges the hourly candles into longer ones or splits them evenly from open to close
+func resampleCandles(candles []ExmoCandle, resolution Resolution) []ExmoCandle {
+	step := resolution.seconds() * 1000
+	const hour = 3600 * 1000
+	if step == hour || step == 0 {
+		return candles
+	}
+
+	var result []ExmoCandle
+	if step > hour {
+		for _, c := range candles {
+			t := c.T / step * step
+			if l := len(result) - 1; l >= 0 && result[l].T == t {
+				result[l].C = c.C
+				result[l].H = math.Max(result[l].H, c.H)
+				result[l].L = math.Min(result[l].L, c.L)
+				result[l].V += c.V
+			} else {
+				c.T = t
+				result = append(result, c)
+			}
+		}
+		return result
+	}
+
+	n := hour / step
+	now := time.Now().Unix() * 1000
+	for _, c := range candles {
+		for k := int64(0); k < n && c.T+k*step <= now; k++ {
+			o := c.O + (c.C-c.O)*float64(k)/float64(n)
+			cl := c.O + (c.C-c.O)*float64(k+1)/float64(n)
+			result = append(result, ExmoCandle{
+				T: c.T + k*step,
+				O: o,
+				C: cl,
+				H: math.Max(o, cl) * 1.001,
+				L: math.Min(o, cl) * 0.999,
+				V: c.V / float64(n),
+			})
+		}
+	}
+	return result
+}
+
+// pairSettings adds default settings for every pair with candles
+func (fake *FakeExmo) pairSettings() interface{} {
+	for pair := range fake.Candles {
+		if _, ok := fake.Settings[pair]; !ok {
+			fake.Settings[pair] = PairSettings{
+				MinQuantity:            0.01,
+				MaxQuantity:            100000,
+				MinPrice:               0.0001,
+				MaxPrice:               100000,
+				MinAmount:              1,
+				MaxAmount:              100000,
+				PricePrecision:         4,
+				CommissionTakerPercent: 0.3,
+				CommissionMakerPercent: 0.3,
+			}
+		}
+	}
+	return fake.Settings
+}
+
+func (fake *FakeExmo) userInfo() interface{} {
+	balances := make(map[Currency]string)
+	reserved := make(map[Currency]string)
+	for currency, amount := range fake.Balance {
+		balances[currency] = f2s(amount)
+		reserved[currency] = f2s(fake.Reserved[currency])
+	}
+	return map[string]interface{}{
+		"uid":         1,
+		"server_date": time.Now().Unix(),
+		"balances":    balances,
+		"reserved":    reserved,
+	}
+}
+
+func (fake *FakeExmo) orderCreate(clientId int64, pair, orderType string, quantity, limitPrice float64) interface{} {
+	left, right := getCurrencies(pair)
+	price := fake.price(pair)
+	if price <= 0 {
+		return fakeError{50304, "Order was not found"}
+	}
+
+	switch orderType {
+	case "market_buy_total":
+		if quantity <= 0 || fake.Balance[right] < quantity {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.Balance[right] -= quantity
+		fake.Balance[left] += quantity / price * (1 - fake.Fee)
+		fake.LastOrderId++
+		fake.addTrade(fake.LastOrderId, clientId, pair, "buy", quantity/price, price, 0)
+	case "market_sell":
+		if quantity <= 0 || fake.Balance[left] < quantity {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.Balance[left] -= quantity
+		fake.Balance[right] += quantity * price * (1 - fake.Fee)
+		fake.LastOrderId++
+		fake.addTrade(fake.LastOrderId, clientId, pair, "sell", quantity, price, 0)
+	case "market_buy":
+		if quantity <= 0 || fake.Balance[right] < quantity*price {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.Balance[right] -= quantity * price
+		fake.Balance[left] += quantity * (1 - fake.Fee)
+		fake.LastOrderId++
+		fake.addTrade(fake.LastOrderId, clientId, pair, "buy", quantity, price, 0)
+	case "buy":
+		if quantity <= 0 || limitPrice <= 0 || fake.Balance[right] < quantity*limitPrice {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.reserve(right, quantity*limitPrice)
+		fake.LastOrderId++
+		fake.Orders[fake.LastOrderId] = FakeOrder{
+			ClientId: clientId,
+			Pair:     pair,
+			Type:     orderType,
+			Quantity: quantity,
+			Price:    limitPrice,
+			Created:  time.Now().Unix(),
+		}
+		fake.fillOrders()
+	case "sell":
+		if quantity <= 0 || limitPrice <= 0 || fake.Balance[left] < quantity {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.reserve(left, quantity)
+		fake.LastOrderId++
+		fake.Orders[fake.LastOrderId] = FakeOrder{
+			ClientId: clientId,
+			Pair:     pair,
+			Type:     orderType,
+			Quantity: quantity,
+			Price:    limitPrice,
+			Created:  time.Now().Unix(),
+		}
+		fake.fillOrders()
+	default:
+		return fakeError{50277, "Unsupported order type: " + orderType}
+	}
+
+	return OrderResponse{Result: true, OrderID: int(fake.LastOrderId), ClientID: int(clientId)}
+}
+
+func (fake *FakeExmo) stopMarketOrderCreate(clientId int64, pair, orderType string, quantity, triggerPrice float64) interface{} {
+	left := getLeftCurrency(pair)
+	switch orderType {
+	case "sell":
+		if quantity <= 0 || fake.Balance[left] < quantity {
+			return fakeError{50052, "Insufficient funds"}
+		}
+		fake.reserve(left, quantity)
+	case "buy":
+		// buy stops pay when triggered
+		if quantity <= 0 {
+			return fakeError{50052, "Insufficient funds"}
+		}
+	default:
+		return fakeError{50277, "Unsupported order type: " + orderType}
+	}
+
+	fake.LastOrderId++
+	fake.StopOrders[fake.LastOrderId] = FakeStopOrder{
+		ClientId:     clientId,
+		Pair:         pair,
+		Quantity:     quantity,
+		TriggerPrice: triggerPrice,
+		Type:         orderType,
+	}
+	return StopOrderResponse{
+		ClientID:         int(clientId),
+		ParentOrderID:    fake.LastOrderId,
+		ParentOrderIDStr: i2s(fake.LastOrderId),
+	}
+}
+
+func (fake *FakeExmo) stopMarketOrderCancel(parentOrderId int64) interface{} {
+	stopOrder, ok := fake.StopOrders[parentOrderId]
+	if !ok {
+		return fakeError{50304, "Order was not found"}
+	}
+	if stopOrder.Type == "sell" {
+		fake.reserve(getLeftCurrency(stopOrder.Pair), -stopOrder.Quantity)
+	}
+	delete(fake.StopOrders, parentOrderId)
+	return map[string]interface{}{}
+}
+
+// triggerStopOrders executes every sell stop with the price below its trigger and every buy stop above it
+func (fake *FakeExmo) triggerStopOrders() {
+	for id, stopOrder := range fake.StopOrders {
+		left, right := getCurrencies(stopOrder.Pair)
+		price := fake.price(stopOrder.Pair)
+		switch {
+		case price <= 0:
+			continue
+		case stopOrder.Type == "sell" && price <= stopOrder.TriggerPrice:
+			fake.Reserved[left] -= stopOrder.Quantity
+			fake.Balance[right] += stopOrder.Quantity * price * (1 - fake.Fee)
+		case stopOrder.Type == "buy" && price >= stopOrder.TriggerPrice:
+			fake.Balance[right] -= stopOrder.Quantity * price
+			fake.Balance[left] += stopOrder.Quantity * (1 - fake.Fee)
+		default:
+			continue
+		}
+		fake.LastOrderId++
+		fake.addTrade(fake.LastOrderId, stopOrder.ClientId, stopOrder.Pair, stopOrder.Type, stopOrder.Quantity, price, id)
+		delete(fake.StopOrders, id)
+	}
+}
+
+func (fake *FakeExmo) marginOrderCreate(form url.Values) interface{} {
+	order := MarginOrder{
+		ClientId:     s2i(form.Get("client_id")),
+		Pair:         form.Get("pair"),
+		Type:         form.Get("type"),
+		Quantity:     s2f(form.Get("quantity")),
+		Price:        s2f(form.Get("price")),
+		TriggerPrice: s2f(form.Get("trigger_price")),
+	}
+	price := fake.price(order.Pair)
+	if price <= 0 {
+		return fakeError{50304, "Order was not found"}
+	}
+
+	switch fake.Margin.create(fake.MarginBalance, fake.LastOrderId+1, order, price, s2f(form.Get("leverage")), fake.Fee) {
+	case nil:
+	case errMarginFunds:
+		return fakeError{50052, "Insufficient funds"}
+	default:
+		return fakeError{50277, "Unsupported order type: " + order.Type}
+	}
+	fake.LastOrderId++
+	return MarginOrderResponse{OrderID: fake.LastOrderId, ClientID: order.ClientId}
+}
+
+func (fake *FakeExmo) marginOrderCancel(orderId int64) interface{} {
+	if !fake.Margin.cancel(orderId) {
+		return fakeError{50304, "Order was not found"}
+	}
+	return map[string]interface{}{}
+}
+
+// triggerMarginOrders fills the margin orders reached by the last price
+func (fake *FakeExmo) triggerMarginOrders() {
+	pairs := make(map[string]bool)
+	for _, order := range fake.Margin.Orders {
+		pairs[order.Pair] = true
+	}
+	for pair := range pairs {
+		if price := fake.price(pair); price > 0 {
+			fake.Margin.trigger(fake.MarginBalance, pair, price, price, price, fake.Fee)
+		}
+	}
+}
+
+func (fake *FakeExmo) marginWallet() interface{} {
+	balances := []map[string]string{}
+	for currency, balance := range fake.MarginBalance {
+		balances = append(balances, map[string]string{
+			"currency": string(currency),
+			"free":     f2s(balance.Available),
+			"used":     f2s(balance.Reserved),
+		})
+	}
+	return map[string]interface{}{"balances": balances}
+}
+
+// fillOrders fills limit orders crossed by the price with the reserved money or coins
+func (fake *FakeExmo) fillOrders() {
+	for id, order := range fake.Orders {
+		price := fake.price(order.Pair)
+		left, right := getCurrencies(order.Pair)
+		switch {
+		case price <= 0:
+			continue
+		case order.Type == "sell" && price >= order.Price:
+			fake.Reserved[left] -= order.Quantity
+			fake.Balance[right] += order.Quantity * price * (1 - fake.Fee)
+			fake.addTrade(id, order.ClientId, order.Pair, "sell", order.Quantity, price, 0)
+		case order.Type != "sell" && price <= order.Price:
+			fake.Reserved[right] -= order.Quantity * order.Price
+			fake.Balance[right] += order.Quantity * (order.Price - price)
+			fake.Balance[left] += order.Quantity * (1 - fake.Fee)
+			fake.addTrade(id, order.ClientId, order.Pair, "buy", order.Quantity, price, 0)
+		default:
+			continue
+		}
+		delete(fake.Orders, id)
+	}
+}
+
+func (fake *FakeExmo) orderCancel(orderId int64) interface{} {
+	order, ok := fake.Orders[orderId]
+	if !ok {
+		return fakeError{50304, "Order was not found"}
+	}
+	if order.Type == "sell" {
+		fake.reserve(getLeftCurrency(order.Pair), -order.Quantity)
+	} else {
+		fake.reserve(getRightCurrency(order.Pair), -order.Quantity*order.Price)
+	}
+	delete(fake.Orders, orderId)
+	return map[string]interface{}{}
+}
+
+// reserve moves the amount from the balance to the reserved one, a negative amount returns it
+func (fake *FakeExmo) reserve(currency Currency, amount float64) {
+	fake.Balance[currency] -= amount
+	fake.Reserved[currency] += amount
+}
+
+func (fake *FakeExmo) orderTrades(orderId int64) interface{} {
+	response := OrderTradesResponse{Trades: []ExmoTrade{}}
+	for _, trades := range fake.Trades {
+		for _, trade := range trades {
+			if trade.OrderID == orderId {
+				response.Type = trade.Type
+				response.Trades = append(response.Trades, trade)
+			}
+		}
+	}
+	if len(response.Trades) == 0 {
+		return fakeError{50304, "Order was not found"}
+	}
+	return response
+}
+
+// orderBook has only the top of the book, one tick around the last price
+func (fake *FakeExmo) orderBook(pair string) interface{} {
+	price := fake.price(pair)
+	return map[string]map[string]string{
+		pair: {
+			"ask_top": f2s(price * 1.001),
+			"bid_top": f2s(price * 0.999),
+		},
+	}
+}
+
+func (fake *FakeExmo) userOpenOrders() interface{} {
+	response := make(map[string][]map[string]string)
+	for id, order := range fake.Orders {
+		response[order.Pair] = append(response[order.Pair], map[string]string{
+			"order_id":        i2s(id),
+			"parent_order_id": "0",
+			"client_id":       i2s(order.ClientId),
+			"created":         i2s(order.Created),
+			"type":            order.Type,
+			"pair":            order.Pair,
+			"quantity":        f2s(order.Quantity),
+			"price":           f2s(order.Price),
+			"trigger_price":   "0",
+			"amount":          f2s(order.Quantity * order.Price),
+		})
+	}
+	for id, stopOrder := range fake.StopOrders {
+		response[stopOrder.Pair] = append(response[stopOrder.Pair], map[string]string{
+			"order_id":        "0",
+			"parent_order_id": i2s(id),
+			"client_id":       i2s(stopOrder.ClientId),
+			"created":         i2s(time.Now().Unix()),
+			"type":            stopOrder.Type,
+			"pair":            stopOrder.Pair,
+			"quantity":        f2s(stopOrder.Quantity),
+			"price":           "0",
+			"trigger_price":   f2s(stopOrder.TriggerPrice),
+			"amount":          "0",
+		})
+	}
+	return response
+}
+
+// userTrades returns the latest trades first like the real api
+func (fake *FakeExmo) userTrades(pair string, limit int) interface{} {
+	var trades []ExmoTrade
+	for i := len(fake.Trades[pair]) - 1; i >= 0 && len(trades) < limit; i-- {
+		trades = append(trades, fake.Trades[pair][i])
+	}
+	return map[string][]ExmoTrade{pair: trades}
+}
+
+func (fake *FakeExmo) addTrade(orderId, clientId int64, pair, tradeType string, quantity, price float64, parentOrderId int64) {
+	fake.Trades[pair] = append(fake.Trades[pair], ExmoTrade{
+		TradeID:          int64(len(fake.Trades[pair]) + 1),
+		Date:             time.Now().Unix(),
+		Type:             tradeType,
+		Pair:             pair,
+		OrderID:          orderId,
+		ClientID:         clientId,
+		ParentOrderID:    parentOrderId,
+		Quantity:         quantity,
+		Price:            price,
+		Amount:           quantity * price,
+		CommissionAmount: quantity * price * fake.Fee,
+	})
+}
+
+// FakeExmoStream is a local stand-in for the public websocket api
+type FakeExmoStream struct {
+	sync.Mutex
+	Fake     *FakeExmo
+	conns    map[*websocket.Conn]map[string]bool
+	upgrader websocket.Upgrader
+	lastId   int64
+}
+
+func newFakeExmoStream(fake *FakeExmo) *FakeExmoStream {
+	if fake == nil {
+		fake = newFakeExmo()
+	}
+	return &FakeExmoStream{
+		Fake:  fake,
+		conns: make(map[*websocket.Conn]map[string]bool),
+	}
+}
+
+// newFakeExmoStreamServer starts the stand-in which publishes a trade for every subscribed pair each second
+func newFakeExmoStreamServer(stream *FakeExmoStream) *httptest.Server {
+	go func() {
+		for range time.Tick(time.Second) {
+			stream.publishPrices()
+		}
+	}()
+	return httptest.NewServer(stream)
+}
+
+func (stream *FakeExmoStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := stream.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	stream.Lock()
+	stream.conns[conn] = make(map[string]bool)
+	_ = conn.WriteJSON(ExmoWsEvent{Ts: time.Now().UnixMilli(), Event: "info", Code: 1, Message: "connection established", SessionId: "fake"})
+	stream.Unlock()
+
+	defer func() {
+		stream.Lock()
+		delete(stream.conns, conn)
+		stream.Unlock()
+		_ = conn.Close()
+	}()
+
+	for {
+		var request ExmoWsRequest
+		if err = conn.ReadJSON(&request); err != nil {
+			return
+		}
+
+		stream.Lock()
+		for _, topic := range request.Topics {
+			switch request.Method {
+			case "subscribe":
+				stream.conns[conn][topic] = true
+				_ = conn.WriteJSON(ExmoWsEvent{Ts: time.Now().UnixMilli(), Event: "subscribed", Id: request.Id, Topic: topic})
+			case "unsubscribe":
+				delete(stream.conns[conn], topic)
+				_ = conn.WriteJSON(ExmoWsEvent{Ts: time.Now().UnixMilli(), Event: "unsubscribed", Id: request.Id, Topic: topic})
+			}
+		}
+		stream.Unlock()
+	}
+}
+
+func (stream *FakeExmoStream) publish(topic string, data interface{}) {
+	bts, _ := json.Marshal(data)
+	event := ExmoWsEvent{Ts: time.Now().UnixMilli(), Event: "update", Topic: topic, Data: bts}
+
+	stream.Lock()
+	defer stream.Unlock()
+	for conn, topics := range stream.conns {
+		if topics[topic] {
+			_ = conn.WriteJSON(event)
+		}
+	}
+}
+
+func (stream *FakeExmoStream) publishTrade(pair string, price, quantity float64) {
+	stream.Lock()
+	stream.lastId++
+	trade := map[string]interface{}{
+		"trade_id": stream.lastId,
+		"type":     "buy",
+		"price":    f2s(price),
+		"quantity": f2s(quantity),
+		"amount":   f2s(price * quantity),
+		"date":     time.Now().Unix(),
+	}
+	stream.Unlock()
+
+	stream.publish("spot/trades:"+pair, []interface{}{trade})
+	stream.publish("spot/ticker:"+pair, map[string]interface{}{
+		"buy_price":  f2s(price),
+		"sell_price": f2s(price),
+		"last_trade": f2s(price),
+		"high":       f2s(price),
+		"low":        f2s(price),
+		"updated":    time.Now().Unix(),
+	})
+}
+
+func (stream *FakeExmoStream) publishPrices() {
+	pairs := make(map[string]bool)
+	stream.Lock()
+	for _, topics := range stream.conns {
+		for topic := range topics {
+			_, pair, _ := strings.Cut(topic, ":")
+			pairs[pair] = true
+		}
+	}
+	stream.Unlock()
+
+	for pair := range pairs {
+		stream.Fake.Lock()
+		price := stream.Fake.price(pair)
+		stream.Fake.Unlock()
+		stream.publishTrade(pair, price, 1)
+	}
+}
+
+// disconnect drops every client connection, clients are expected to reconnect
+func (stream *FakeExmoStream) disconnect() {
+	stream.Lock()
+	defer stream.Unlock()
+	for conn := range stream.conns {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// exmoDefaultLeverage is the smallest leverage of the exmo margin pairs
+const exmoDefaultLeverage = 2
+
+// ExmoMargin is the margin wallet of the exmo account. It is order based: a sell without coins opens a short position
+// with the leverage of the order, the buys close it. The coins are lent by exmo, there are no loans to repay
+type ExmoMargin struct {
+	exmo *Exmo
+}
+
+// margin is the margin wallet of the account, paper trading keeps it in the paper wallet
+func (exmo *Exmo) margin() OrderApi {
+	return &ExmoMargin{exmo: exmo}
+}
+
+func (margin *ExmoMargin) leverage() float64 {
+	if margin.exmo.Leverage > 0 {
+		return margin.exmo.Leverage
+	}
+	return exmoDefaultLeverage
+}
+
+// apiCreateOrder places an order of the margin types: market_buy, market_sell, limit_buy, limit_sell, stop_buy, stop_sell.
+// Price is the market price the caller saw, the limit price or the trigger price of the type
+func (margin *ExmoMargin) apiCreateOrder(pair, orderType string, quantity, price float64) (int64, error) {
+	exmo := margin.exmo
+	settings, err := exmo.getPairSettings(pair)
+	if err != nil {
+		return 0, err
+	}
+	quantity = settings.roundQuantity(quantity)
+	if err = settings.check(pair, quantity, price); err != nil {
+		return 0, err
+	}
+
+	params := ApiParams{
+		"pair":     pair,
+		"type":     orderType,
+		"quantity": formatFloat(quantity, exmoQuantityPrecision),
+		"leverage": f2s(margin.leverage()),
+	}
+	switch {
+	case strings.HasPrefix(orderType, "limit_"):
+		params["price"] = formatFloat(settings.roundPrice(price), settings.PricePrecision)
+	case strings.HasPrefix(orderType, "stop_"):
+		params["trigger_price"] = formatFloat(settings.roundPrice(price), settings.PricePrecision)
+	}
+
+	if exmo.Wallet != nil {
+		// paper market orders are filled at the price of the caller, the others wait for the candles
+		if !strings.HasPrefix(orderType, "market_") {
+			price = exmo.lastPrice(pair)
+		}
+		return exmo.Wallet.createMarginOrder(params, price)
+	}
+
+	var response MarginOrderResponse
+	err = exmo.apiCreate("margin/user/order/create", params, &response, func(orderId int64) {
+		response.OrderID = orderId
+	})
+	if err == nil && response.OrderID == 0 {
+		err = &ExmoError{Method: "margin/user/order/create", Message: "empty order_id"}
+	}
+
+	return response.OrderID, err
+}
+
+func (margin *ExmoMargin) apiCancelOrder(orderId int64) error {
+	if margin.exmo.Wallet != nil {
+		return margin.exmo.Wallet.cancelMarginOrder(orderId)
+	}
+
+	return margin.exmo.apiCall("margin/user/order/cancel", ApiParams{"order_id": i2s(orderId)}, nil)
+}
+
+func (margin *ExmoMargin) apiGetOpenOrders() ([]ExmoMarginOrder, error) {
+	if margin.exmo.Wallet != nil {
+		return margin.exmo.Wallet.Margin.openOrders(), nil
+	}
+
+	var response MarginOrdersResponse
+	err := margin.exmo.apiCall("margin/user/order/list", ApiParams{}, &response)
+
+	return response.Orders, err
+}
+
+// apiGetTrades returns the latest trades first
+func (margin *ExmoMargin) apiGetTrades(pair string, limit int) ([]ExmoTrade, error) {
+	if margin.exmo.Wallet != nil {
+		return margin.exmo.Wallet.Margin.trades(pair, limit), nil
+	}
+
+	params := ApiParams{
+		"pair":  pair,
+		"limit": strconv.Itoa(limit),
+	}
+
+	var response MarginTradesResponse
+	err := margin.exmo.apiCall("margin/user/trades", params, &response)
+
+	return response.Trades, err
+}
+
+// findMarginClientOrder looks for the order in the open margin orders and the last margin trades of the pair
+func (exmo *Exmo) findMarginClientOrder(order ClientOrder) (int64, bool, error) {
+	margin := &ExmoMargin{exmo: exmo}
+	openOrders, err := margin.apiGetOpenOrders()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, openOrder := range openOrders {
+		if openOrder.ClientID == order.Id {
+			return openOrder.OrderID, true, nil
+		}
+	}
+
+	trades, err := margin.apiGetTrades(order.Pair, 100)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, trade := range trades {
+		if trade.ClientID == order.Id {
+			return trade.OrderID, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// the methods below implement OrderApi on top of the margin api
+
+// getBalances: the paper margin wallet trades with the money of the paper wallet
+func (margin *ExmoMargin) getBalances() (Balances, error) {
+	if margin.exmo.Wallet != nil {
+		return margin.exmo.Wallet.Balance, nil
+	}
+
+	var response MarginWalletResponse
+	if err := margin.exmo.apiCall("margin/user/wallet/list", ApiParams{}, &response); err != nil {
+		return nil, err
+	}
+	return response.balances(), nil
+}
+
+func (margin *ExmoMargin) placeMarketOrder(pair, side string, quantity, price float64) (int64, error) {
+	return margin.apiCreateOrder(pair, "market_"+side, quantity, price)
+}
+
+func (margin *ExmoMargin) placeLimitOrder(pair, side string, quantity, price float64) (int64, error) {
+	return margin.apiCreateOrder(pair, "limit_"+side, quantity, price)
+}
+
+func (margin *ExmoMargin) cancelOrder(pair string, orderId int64) error {
+	return margin.apiCancelOrder(orderId)
+}
+
+// getOrderStatus: an order is open while it is in the order list, the filled part comes from the last trades
+func (margin *ExmoMargin) getOrderStatus(pair string, orderId int64) (OrderStatus, error) {
+	openOrders, err := margin.apiGetOpenOrders()
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	trades, err := margin.apiGetTrades(pair, 100)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+
+	var status OrderStatus
+	for _, order := range openOrders {
+		if order.OrderID == orderId {
+			status.Open = true
+		}
+	}
+	for _, trade := range trades {
+		if trade.OrderID == orderId {
+			status.Quantity += trade.Quantity
+			status.Amount += trade.Amount
+			status.Fee += trade.fee()
+		}
+	}
+	return status, nil
+}
+
+func (margin *ExmoMargin) placeStop(pair, side string, quantity, triggerPrice float64) (int64, error) {
+	return margin.apiCreateOrder(pair, "stop_"+side, quantity, triggerPrice)
+}
+
+func (margin *ExmoMargin) cancelStop(pair string, stopId int64) error {
+	return margin.apiCancelOrder(stopId)
+}
+
+func (margin *ExmoMargin) getStopOrders(pair string) ([]StopOrder, error) {
+	openOrders, err := margin.apiGetOpenOrders()
+	if err != nil {
+		return nil, err
+	}
+
+	var stopOrders []StopOrder
+	for _, order := range openOrders {
+		if order.Pair != pair || !strings.HasPrefix(order.Type, "stop_") {
+			continue
+		}
+		stopOrders = append(stopOrders, StopOrder{
+			Id:           order.OrderID,
+			Side:         strings.TrimPrefix(order.Type, "stop_"),
+			Quantity:     order.Quantity,
+			TriggerPrice: order.TriggerPrice,
+		})
+	}
+	return stopOrders, nil
+}
+
+// getTrades: a triggered stop is filled by the stop order itself, so every trade is its own stop
+func (margin *ExmoMargin) getTrades(pair string, limit int) ([]Trade, error) {
+	response, err := margin.apiGetTrades(pair, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var trades []Trade
+	for _, trade := range response {
+		trade := trade.transform()
+		trade.StopId = trade.OrderId
+		trades = append(trades, trade)
+	}
+	return trades, nil
+}
+
+// placeOco: margin orders do not reserve the position, so the stop and the limit rest side by side.
+// The stop is placed first, it is kept when the take profit fails
+func (margin *ExmoMargin) placeOco(pair, side string, quantity, takeProfitPrice, stopLossPrice float64) (int64, int64, error) {
+	stopId, err := margin.placeStop(pair, side, quantity, stopLossPrice)
+	if err != nil {
+		return 0, 0, err
+	}
+	orderId, err := margin.placeLimitOrder(pair, side, quantity, takeProfitPrice)
+	return orderId, stopId, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// newTestExmo starts the bundled fake server, the pairs of the candles get the default settings
+func newTestExmo(t *testing.T, candles map[string][]ExmoCandle) (*Exmo, *FakeExmo) {
+	inTempDir(t)
+	exmo := new(Exmo)
+	exmo.initClient("fake", 0, nil)
+	for pair, pairCandles := range candles {
+		exmo.Fake.setCandles(pair, pairCandles)
+	}
+	if _, err := exmo.apiGetUserInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exmo.apiGetPairSettings(); err != nil {
+		t.Fatal(err)
+	}
+	exmo.Orders = newClientOrders("exmo_orders.dat")
+	return exmo, exmo.Fake
+}
+
+// newTestEngine is an account without telegram, its strategies have the history downloaded
+func newTestEngine(t *testing.T, api ApiInterface, strategies ...Strategy) *Engine {
+	engine := newEngine(api, &TgBot{}, "exmo", 1, nil)
+	for i := range strategies {
+		strategies[i].Exchange = "exmo"
+	}
+	engine.Strategies = strategies
+	api.downloadHistoryCandlesForStrategies(getUniqueStrategies(strategies))
+	engine.reconcile(strategies)
+	return engine
+}
+
+// hourlyCandles are flat at the price until the last closed hour, prices are the closes of the last hours
+func hourlyCandles(price float64, prices ...float64) []ExmoCandle {
+	const count = 100
+	now := time.Now().Unix() / 3600 * 3600
+	candles := make([]ExmoCandle, count)
+	for i := range candles {
+		c := price
+		if j := i - (count - len(prices)); j >= 0 {
+			c = prices[j]
+		}
+		o := c
+		if i > 0 {
+			o = candles[i-1].C
+		}
+		candles[i] = ExmoCandle{
+			T: (now - int64(count-1-i)*3600) * 1000,
+			O: o,
+			C: c,
+			H: math.Max(o, c) * 1.001,
+			L: math.Min(o, c) * 0.999,
+			V: 1000,
+		}
+	}
+	return candles
+}
+
+// testStrategy opens when the close is 1% above its average of 10 candles and takes 2% of profit
+func testStrategy(pair string, strategyType StrategyType) Strategy {
+	return Strategy{
+		Pair:       pair,
+		Resolution: defaultResolution,
+		Type:       strategyType,
+		Op:         100,
+		Ind1:       Indicator{IndicatorType: IndicatorTypeSma, BarType: C, Coef: 1},
+		Tp:         200,
+		Ind2:       Indicator{IndicatorType: IndicatorTypeSma, BarType: C, Coef: 10},
+		Sl:         2000,
+	}
+}
+
+func TestExmoOpenClose(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 21, 21)})
+	strategy := testStrategy("ETC_USDT", Long)
+	engine := newTestEngine(t, exmo, strategy)
+
+	engine.checkForOpen(engine.Strategies)
+
+	// exmo spot holds the coins for the stop loss only, there is no take profit order and the Tp is closed by market
+	openedOrder := engine.OpenedOrder
+	if !engine.isOrderOpened() || openedOrder.OpenedPrice != 21 || openedOrder.StopLossOrderId == 0 ||
+		openedOrder.TakeProfitOrderId != 0 || openedOrder.TakeProfitPrice != 0 {
+		t.Fatalf("opened price %f, stop loss %d, take profit %d at %f", openedOrder.OpenedPrice,
+			openedOrder.StopLossOrderId, openedOrder.TakeProfitOrderId, openedOrder.TakeProfitPrice)
+	}
+	fake.Lock()
+	coins, reserved := fake.Balance["ETC"], fake.Reserved["ETC"]
+	wantCoins := 1000 / 21.0 * (1 - fake.Fee)
+	stopOrders := len(fake.StopOrders)
+	fake.Unlock()
+	if coins > 1e-6 || math.Abs(reserved-wantCoins) > 1e-6 || stopOrders != 1 {
+		t.Errorf("coins %f, reserved %f, want %f, stop orders %d", coins, reserved, wantCoins, stopOrders)
+	}
+
+	// the price goes above the take profit
+	fake.setCandles("ETC_USDT", hourlyCandles(20, 21, 22, 22))
+	engine.checkForClose()
+
+	if engine.isOrderOpened() {
+		t.Fatalf("the position is not closed %+v", engine.OpenedOrder)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.Balance["ETC"] > 1e-6 || fake.Reserved["ETC"] > 1e-6 || len(fake.StopOrders) != 0 || len(fake.Orders) != 0 {
+		t.Errorf("left coins %f, reserved %f, stop orders %d, orders %d",
+			fake.Balance["ETC"], fake.Reserved["ETC"], len(fake.StopOrders), len(fake.Orders))
+	}
+	if fake.Balance["USDT"] < 1000*(1+float64(strategy.Tp)/10000) {
+		t.Errorf("money %f, the profit is lower than Tp", fake.Balance["USDT"])
+	}
+}
+
+// TestExmoLostOrderResponse: the order is executed but the response is lost, it is found by the client id
+func TestExmoLostOrderResponse(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20)})
+
+	fake.Lock()
+	fake.DropResponses = 1
+	fake.Unlock()
+	orderId, err := exmo.marketBuyTotal("ETC_USDT", 100, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if trades := fake.Trades["ETC_USDT"]; len(trades) != 1 || trades[0].OrderID != orderId {
+		t.Errorf("trades %+v of order %d", trades, orderId)
+	}
+	if pending := exmo.Orders.pending(); len(pending) != 0 {
+		t.Errorf("pending client orders %+v", pending)
+	}
+}
+
+// TestExmoShortOpenClose: the short is sold on the margin wallet and bought back by its take profit
+func TestExmoShortOpenClose(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 19, 19)})
+	strategy := testStrategy("ETC_USDT", Short)
+	engine := newTestEngine(t, exmo, strategy)
+
+	engine.checkForOpen(engine.Strategies)
+
+	openedOrder := engine.OpenedOrder
+	if !engine.isOrderOpened() || openedOrder.OpenedPrice != 19 || openedOrder.StopLossOrderId == 0 || openedOrder.TakeProfitOrderId == 0 {
+		t.Fatalf("opened order %+v", openedOrder)
+	}
+	fake.Lock()
+	position := fake.Margin.Positions["ETC_USDT"]
+	marginOrders := len(fake.Margin.Orders)
+	spotCoins := fake.Balance["ETC"]
+	fake.Unlock()
+	if math.Abs(position+1000/19.0) > 1e-6 || marginOrders != 2 || spotCoins != 0 {
+		t.Errorf("position %f, margin orders %d, spot coins %f", position, marginOrders, spotCoins)
+	}
+
+	// the price goes below the take profit
+	fake.setCandles("ETC_USDT", hourlyCandles(20, 19, 18, 18))
+	engine.checkForClose()
+
+	if engine.isOrderOpened() {
+		t.Fatalf("the position is not closed %+v", engine.OpenedOrder)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	if position = fake.Margin.Positions["ETC_USDT"]; math.Abs(position) > 1e-6 || len(fake.Margin.Orders) != 0 {
+		t.Errorf("left position %f, margin orders %d", position, len(fake.Margin.Orders))
+	}
+	if money := fake.MarginBalance.available("USDT"); money < 1000*(1+float64(strategy.Tp)/10000) {
+		t.Errorf("money %f, the profit is lower than Tp", money)
+	}
+}
+
+// TestExmoCandlesOutage: the history is not downloaded at the start, the engine waits for it instead of panicking
+func TestExmoCandlesOutage(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": {}})
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Long))
+
+	engine.checkForOpen(engine.Strategies)
+	if engine.isOrderOpened() {
+		t.Fatal("opened without candles")
+	}
+
+	fake.setCandles("ETC_USDT", hourlyCandles(20, 21, 21))
+	exmo.downloadNewCandleForStrategies(engine.Strategies)
+	if n := engine.Strategies[0].candlesSnapshot().len(); n != 100 {
+		t.Fatalf("candles %d after the retry, want the history of 100", n)
+	}
+	engine.checkForOpen(engine.Strategies)
+	if !engine.isOrderOpened() {
+		t.Error("not opened after the history is downloaded")
+	}
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
 	"time"
 )
 
 type Exmo struct {
-	Key              string
-	Secret           string
-	AvailableDeposit float64
-	Balance          CurrencyBalanceResponse
-	OpenedOrder      OpenedOrder
-}
-
-type OpenedOrder struct {
-	Strategy
-	OpenedPrice      float64
-	StopLossOrderId  int64
-	ReplyToMessageID int
+	Account      string
+	Key          string
+	Secret       string
+	Balance      Balances
+	Wallet       *PaperWallet
+	BaseUrl      string
+	Client       *http.Client
+	Stats        ApiStats
+	Stream       *ExmoStream
+	Fake         *FakeExmo
+	Orders       *ClientOrders
+	PairSettings PairSettingsResponse
+	// Leverage of the margin orders, exmoDefaultLeverage when not set
+	Leverage float64
 }
 
 type Currency string
@@ -25,37 +33,8 @@ func (candleHistory ExmoCandleHistoryResponse) isEmpty() bool {
 	return len(candleHistory.Candles) == 0
 }
 
-func (order OpenedOrder) isEmpty() bool {
-	return order.Strategy.Pair == ""
-}
-
-type Price float64
-
-type CurrencyBalanceResponse struct {
-	USDT Price `json:"USDT,string"`
-	ETC  Price `json:"ETC,string"`
-	UNI  Price `json:"UNI,string"`
-	ALGO Price `json:"ALGO,string"`
-}
-
 func (c ExmoCandle) transform() Candle {
-	return Candle{
-		c.L,
-		c.O,
-		c.C,
-		c.H,
-		(c.L + c.O) * 0.5,
-		(c.L + c.C) * 0.5,
-		(c.L + c.H) * 0.5,
-		(c.O + c.C) * 0.5,
-		(c.O + c.H) * 0.5,
-		(c.C + c.H) * 0.5,
-		(c.L + c.O + c.C) / 3.0,
-		(c.L + c.O + c.H) / 3.0,
-		(c.L + c.C + c.H) / 3.0,
-		(c.O + c.C + c.H) / 3.0,
-		time.Unix(c.T/1000, 0),
-	}
+	return newCandle(c.L, c.O, c.C, c.H, c.V, time.Unix(c.T/1000, 0))
 }
 
 type ExmoCandleHistoryResponse struct {
@@ -69,6 +48,7 @@ type ExmoCandle struct {
 	C float64 `json:"c"`
 	H float64 `json:"h"`
 	L float64 `json:"l"`
+	V float64 `json:"v"`
 }
 
 type OrderResponse struct {
@@ -78,23 +58,275 @@ type OrderResponse struct {
 	ClientID int    `json:"client_id"`
 }
 
-func (response OrderResponse) isSuccess() bool {
-	return response.Error == ""
-}
-
 type StopOrderResponse struct {
 	ClientID         int    `json:"client_id"`
 	ParentOrderID    int64  `json:"parent_order_id"`
 	ParentOrderIDStr string `json:"parent_order_id_str"`
 }
 
-func (response StopOrderResponse) isSuccess() bool {
-	return response.ParentOrderID > 0
-}
-
 type UserInfoResponse struct {
 	//UID        int                     `json:"uid"`
 	//ServerDate int                     `json:"server_date"`
-	Balances CurrencyBalanceResponse `json:"balances"`
-	//Reserved   CurrencyBalanceResponse `json:"reserved"`
+	Balances map[Currency]string `json:"balances"`
+	Reserved map[Currency]string `json:"reserved"`
+}
+
+const (
+	ExmoErrorInsufficientFunds = 50052
+	ExmoErrorOrderNotFound     = 50304
+)
+
+// ExmoError is a failure reported by the api as {"result":false,"error":"Error 50052: Insufficient funds"}
+type ExmoError struct {
+	Code    int
+	Message string
+	Method  string
+}
+
+func (e *ExmoError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("exmo %s: %s", e.Method, e.Message)
+	}
+	return fmt.Sprintf("exmo %s: %d %s", e.Method, e.Code, e.Message)
+}
+
+type ExmoErrorResponse struct {
+	Result *bool  `json:"result"`
+	Error  string `json:"error"`
+	S      string `json:"s"`
+	ErrMsg string `json:"errmsg"`
+}
+
+var exmoErrorRegexp = regexp.MustCompile(`^Error (\d+): ?(.*)$`)
+
+func parseExmoError(method string, bts []byte) error {
+	var response ExmoErrorResponse
+	if err := json.Unmarshal(bts, &response); err != nil {
+		// arrays and other non-object responses have no error envelope
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil
+		}
+		return &ExmoError{Method: method, Message: "decode: " + err.Error()}
+	}
+
+	message := response.Error
+	if response.S == "error" {
+		message = response.ErrMsg
+	}
+	if message == "" && (response.Result == nil || *response.Result) && response.S != "error" {
+		return nil
+	}
+
+	exmoError := &ExmoError{Method: method, Message: message}
+	if matches := exmoErrorRegexp.FindStringSubmatch(message); matches != nil {
+		exmoError.Code = int(s2i(matches[1]))
+		exmoError.Message = matches[2]
+	}
+	return exmoError
+}
+
+// Is lets errors.Is match the api code with the exchange independent errors
+func (e *ExmoError) Is(target error) bool {
+	return target == ErrOrderNotFound && e.Code == ExmoErrorOrderNotFound
+}
+
+func isExmoErrorCode(err error, code int) bool {
+	var exmoError *ExmoError
+	return errors.As(err, &exmoError) && exmoError.Code == code
+}
+
+// exmo does not publish quantity precision, orders accept up to 8 decimals
+const exmoQuantityPrecision = 8
+
+type PairSettingsResponse map[string]PairSettings
+
+type PairSettings struct {
+	MinQuantity            float64 `json:"min_quantity,string"`
+	MaxQuantity            float64 `json:"max_quantity,string"`
+	MinPrice               float64 `json:"min_price,string"`
+	MaxPrice               float64 `json:"max_price,string"`
+	MinAmount              float64 `json:"min_amount,string"`
+	MaxAmount              float64 `json:"max_amount,string"`
+	PricePrecision         int     `json:"price_precision"`
+	CommissionTakerPercent float64 `json:"commission_taker_percent,string"`
+	CommissionMakerPercent float64 `json:"commission_maker_percent,string"`
+}
+
+func (settings PairSettings) roundPrice(price float64) float64 {
+	pow := math.Pow10(settings.PricePrecision)
+	return math.Round(price*pow) / pow
+}
+
+func (settings PairSettings) roundQuantity(quantity float64) float64 {
+	pow := math.Pow10(exmoQuantityPrecision)
+	return math.Floor(quantity*pow) / pow
+}
+
+func (settings PairSettings) roundAmount(amount float64) float64 {
+	return settings.roundQuantity(amount)
+}
+
+func (settings PairSettings) check(pair string, quantity, price float64) error {
+	amount := quantity * price
+
+	var reason string
+	switch {
+	case quantity < settings.MinQuantity:
+		reason = fmt.Sprintf("quantity %v is less than min_quantity %v", quantity, settings.MinQuantity)
+	case settings.MaxQuantity > 0 && quantity > settings.MaxQuantity:
+		reason = fmt.Sprintf("quantity %v is greater than max_quantity %v", quantity, settings.MaxQuantity)
+	case price < settings.MinPrice:
+		reason = fmt.Sprintf("price %v is less than min_price %v", price, settings.MinPrice)
+	case settings.MaxPrice > 0 && price > settings.MaxPrice:
+		reason = fmt.Sprintf("price %v is greater than max_price %v", price, settings.MaxPrice)
+	case amount < settings.MinAmount:
+		reason = fmt.Sprintf("amount %v is less than min_amount %v", amount, settings.MinAmount)
+	case settings.MaxAmount > 0 && amount > settings.MaxAmount:
+		reason = fmt.Sprintf("amount %v is greater than max_amount %v", amount, settings.MaxAmount)
+	default:
+		return nil
+	}
+
+	return &OrderRejectedError{Pair: pair, Reason: reason}
+}
+
+type OpenOrdersResponse map[string][]ExmoOpenOrder
+
+// ExmoOpenOrder is an order from user_open_orders, triggered stop orders have a parent order id
+type ExmoOpenOrder struct {
+	OrderID       int64   `json:"order_id,string"`
+	ParentOrderID int64   `json:"parent_order_id,string"`
+	ClientID      int64   `json:"client_id,string"`
+	Created       int64   `json:"created,string"`
+	Type          string  `json:"type"`
+	Pair          string  `json:"pair"`
+	Quantity      float64 `json:"quantity,string"`
+	Price         float64 `json:"price,string"`
+	TriggerPrice  float64 `json:"trigger_price,string"`
+	Amount        float64 `json:"amount,string"`
+}
+
+func (orders OpenOrdersResponse) stopOrders(pair string) []ExmoOpenOrder {
+	var stopOrders []ExmoOpenOrder
+	for _, order := range orders[pair] {
+		if order.ParentOrderID != 0 {
+			stopOrders = append(stopOrders, order)
+		}
+	}
+	return stopOrders
+}
+
+type UserTradesResponse map[string][]ExmoTrade
+
+type ExmoTrade struct {
+	TradeID            int64   `json:"trade_id"`
+	Date               int64   `json:"date"`
+	Type               string  `json:"type"`
+	Pair               string  `json:"pair"`
+	OrderID            int64   `json:"order_id"`
+	ClientID           int64   `json:"client_id"`
+	ParentOrderID      int64   `json:"parent_order_id"`
+	Quantity           float64 `json:"quantity,string"`
+	Price              float64 `json:"price,string"`
+	Amount             float64 `json:"amount,string"`
+	CommissionAmount   float64 `json:"commission_amount,string"`
+	CommissionCurrency string  `json:"commission_currency"`
+}
+
+type OrderBookResponse map[string]OrderBook
+
+type OrderBook struct {
+	AskTop float64 `json:"ask_top,string"`
+	BidTop float64 `json:"bid_top,string"`
+}
+
+type OrderTradesResponse struct {
+	Type      string      `json:"type"`
+	InAmount  float64     `json:"in_amount,string"`
+	OutAmount float64     `json:"out_amount,string"`
+	Trades    []ExmoTrade `json:"trades"`
+}
+
+// fill returns bought or sold coins, money spent or received by the order and the paid commission
+func (response OrderTradesResponse) fill() (quantity, amount, fee float64) {
+	for _, trade := range response.Trades {
+		quantity += trade.Quantity
+		amount += trade.Amount
+		fee += trade.fee()
+	}
+	return quantity, amount, fee
+}
+
+func (orders OpenOrdersResponse) contains(pair string, orderId int64) bool {
+	for _, order := range orders[pair] {
+		if order.OrderID == orderId {
+			return true
+		}
+	}
+	return false
+}
+
+type MarginOrderResponse struct {
+	OrderID  int64 `json:"order_id,string"`
+	ClientID int64 `json:"client_id,string"`
+}
+
+type MarginOrdersResponse struct {
+	Orders []ExmoMarginOrder `json:"orders"`
+}
+
+// ExmoMarginOrder is an open order of the margin wallet, stop orders are orders of the stop_buy and stop_sell types
+type ExmoMarginOrder struct {
+	OrderID      int64   `json:"order_id,string"`
+	ClientID     int64   `json:"client_id,string"`
+	Created      int64   `json:"created,string"`
+	Type         string  `json:"type"`
+	Pair         string  `json:"pair"`
+	Quantity     float64 `json:"quantity,string"`
+	Price        float64 `json:"price,string"`
+	TriggerPrice float64 `json:"trigger_price,string"`
+}
+
+type MarginTradesResponse struct {
+	Trades []ExmoTrade `json:"trades"`
+}
+
+type MarginWalletResponse struct {
+	Balances []ExmoMarginBalance `json:"balances"`
+}
+
+type ExmoMarginBalance struct {
+	Currency Currency `json:"currency"`
+	Free     float64  `json:"free,string"`
+	Used     float64  `json:"used,string"`
+}
+
+func (response MarginWalletResponse) balances() Balances {
+	balances := make(Balances)
+	for _, balance := range response.Balances {
+		balances.add(balance.Currency, balance.Free, balance.Used)
+	}
+	return balances
+}
+
+func (trade ExmoTrade) transform() Trade {
+	return Trade{
+		Id:       trade.TradeID,
+		Date:     trade.Date,
+		Side:     trade.Type,
+		OrderId:  trade.OrderID,
+		StopId:   trade.ParentOrderID,
+		Quantity: trade.Quantity,
+		Price:    trade.Price,
+		Amount:   trade.Amount,
+		Fee:      trade.fee(),
+	}
+}
+
+// fee converts the commission to the right currency, buys pay it in coins
+func (trade ExmoTrade) fee() float64 {
+	if trade.CommissionCurrency == "" || Currency(trade.CommissionCurrency) == getRightCurrency(trade.Pair) {
+		return trade.CommissionAmount
+	}
+	return trade.CommissionAmount * trade.Price
 }
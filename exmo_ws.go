@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/gorilla/websocket"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const exmoWsUrl = "wss://ws-api.exmo.com:443/v1/public"
+
+// ExmoStream keeps a websocket connection to the public api, reconnects and resubscribes on failures
+type ExmoStream struct {
+	Url        string
+	Backoff    Backoff
+	Reconnects int64
+	Updates    int64
+}
+
+type ExmoWsEvent struct {
+	Ts        int64           `json:"ts"`
+	Event     string          `json:"event"`
+	Id        int64           `json:"id"`
+	Topic     string          `json:"topic"`
+	Code      int             `json:"code"`
+	Message   string          `json:"message"`
+	SessionId string          `json:"session_id"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type ExmoWsRequest struct {
+	Id     int64    `json:"id"`
+	Method string   `json:"method"`
+	Topics []string `json:"topics"`
+}
+
+type ExmoWsTrade struct {
+	TradeId  int64   `json:"trade_id"`
+	Type     string  `json:"type"`
+	Price    float64 `json:"price,string"`
+	Quantity float64 `json:"quantity,string"`
+	Amount   float64 `json:"amount,string"`
+	Date     int64   `json:"date"`
+}
+
+type ExmoWsTicker struct {
+	BuyPrice  float64 `json:"buy_price,string"`
+	SellPrice float64 `json:"sell_price,string"`
+	LastTrade float64 `json:"last_trade,string"`
+	High      float64 `json:"high,string"`
+	Low       float64 `json:"low,string"`
+	Updated   int64   `json:"updated"`
+}
+
+// split returns channel and pair of the topic "spot/trades:BTC_USD"
+func (event ExmoWsEvent) split() (string, string) {
+	channel, pair, _ := strings.Cut(event.Topic, ":")
+	return channel, pair
+}
+
+func newExmoStream(url string) *ExmoStream {
+	return &ExmoStream{
+		Url: url,
+		Backoff: Backoff{
+			Base: time.Second,
+			Max:  time.Minute,
+		},
+	}
+}
+
+// run never returns: every lost connection is reopened with the same topics
+func (stream *ExmoStream) run(topics []string, onUpdate func(ExmoWsEvent)) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := stream.listen(topics, onUpdate)
+		if time.Since(start) > stream.Backoff.Max {
+			attempt = 0
+		}
+		delay := stream.Backoff.delay(attempt)
+		atomic.AddInt64(&stream.Reconnects, 1)
+		color.HiYellow("STREAM reconnect in %s: %+v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func (stream *ExmoStream) listen(topics []string, onUpdate func(ExmoWsEvent)) error {
+	conn, _, err := websocket.DefaultDialer.Dial(stream.Url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(ExmoWsRequest{Id: time.Now().Unix(), Method: "subscribe", Topics: topics})
+	if err != nil {
+		return err
+	}
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Minute))
+		var event ExmoWsEvent
+		if err = conn.ReadJSON(&event); err != nil {
+			return err
+		}
+
+		switch event.Event {
+		case "info":
+			color.HiBlue("STREAM %s %s", event.Message, event.SessionId)
+		case "subscribed":
+			color.HiBlue("STREAM subscribed %s", event.Topic)
+		case "error":
+			return fmt.Errorf("stream error %d: %s", event.Code, event.Message)
+		case "update", "snapshot":
+			atomic.AddInt64(&stream.Updates, 1)
+			onUpdate(event)
+		}
+	}
+}
+
+func (stream *ExmoStream) String() string {
+	return fmt.Sprintf("stream updates:%d reconnects:%d",
+		atomic.LoadInt64(&stream.Updates),
+		atomic.LoadInt64(&stream.Reconnects),
+	)
+}
+
+// initStream: "" disables streaming, "on" uses the exmo url, "fake" starts the bundled stand-in
+func (exmo *Exmo) initStream(url string) {
+	switch url {
+	case "":
+		return
+	case "on":
+		url = exmoWsUrl
+	case "fake":
+		url = "ws" + strings.TrimPrefix(newFakeExmoStreamServer(newFakeExmoStream(exmo.Fake)).URL, "http")
+		color.HiYellow("Fake exmo stream: %s", url)
+	}
+	exmo.Stream = newExmoStream(url)
+}
+
+func (exmo *Exmo) streamTopics(strategies []Strategy) []string {
+	var topics []string
+	for _, pair := range getUniquePairs(strategies) {
+		topics = append(topics, "spot/trades:"+pair, "spot/ticker:"+pair)
+	}
+	return topics
+}
+
+func (exmo *Exmo) onStreamUpdate(event ExmoWsEvent, onTick func(pair string, price, quantity float64, t time.Time, isTrade bool)) {
+	channel, pair := event.split()
+	switch channel {
+	case "spot/trades":
+		var trades []ExmoWsTrade
+		if err := json.Unmarshal(event.Data, &trades); err != nil {
+			color.HiRed("ERROR stream trades %+v", err)
+			return
+		}
+		for _, trade := range trades {
+			onTick(pair, trade.Price, trade.Quantity, time.Unix(trade.Date, 0), true)
+		}
+	case "spot/ticker":
+		var ticker ExmoWsTicker
+		if err := json.Unmarshal(event.Data, &ticker); err != nil {
+			color.HiRed("ERROR stream ticker %+v", err)
+			return
+		}
+		onTick(pair, ticker.LastTrade, 0, time.Unix(ticker.Updated, 0), false)
+	}
+}
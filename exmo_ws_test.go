@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls the condition, the stream is read by its own goroutine
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func (stream *FakeExmoStream) subscribed(topic string) bool {
+	stream.Lock()
+	defer stream.Unlock()
+	for _, topics := range stream.conns {
+		if topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExmoStreamReconnect(t *testing.T) {
+	exmo, fake := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20)})
+	stream := newFakeExmoStream(fake)
+	server := httptest.NewServer(stream)
+	t.Cleanup(server.Close)
+	exmo.Stream = newExmoStream("ws" + strings.TrimPrefix(server.URL, "http"))
+	exmo.Stream.Backoff.Base = 10 * time.Millisecond
+
+	strategy := testStrategy("ETC_USDT", Long)
+	engine := newTestEngine(t, exmo, strategy)
+	exmo.listenPrices(engine.Strategies, engine.onTick)
+
+	liveCandle := func() Candle {
+		snapshot := engine.Strategies[0].candlesSnapshot()
+		i := snapshot.index()
+		return newCandle(snapshot.Candles[L][i], snapshot.Candles[O][i], snapshot.Candles[C][i], snapshot.Candles[H][i],
+			snapshot.Candles[V][i], snapshot.Time[i])
+	}
+	start := liveCandle()
+
+	waitFor(t, "subscription", func() bool { return stream.subscribed("spot/trades:ETC_USDT") })
+	stream.publishTrade("ETC_USDT", 25, 1.5)
+	waitFor(t, "the live candle", func() bool { return liveCandle().C == 25 })
+
+	stream.disconnect()
+	waitFor(t, "reconnect", func() bool {
+		return atomic.LoadInt64(&exmo.Stream.Reconnects) > 0 && stream.subscribed("spot/trades:ETC_USDT")
+	})
+	stream.publishTrade("ETC_USDT", 15, 0.5)
+	waitFor(t, "the live candle after reconnect", func() bool { return liveCandle().C == 15 })
+
+	candle := liveCandle()
+	if !candle.T.Equal(start.T) || candle.O != start.O || candle.H != 25 || candle.L != 15 || candle.V != start.V+2 {
+		t.Errorf("live candle %+v, started as %+v", candle, start)
+	}
+}
+
+// TestTicksPastRestingTakeProfit: the ticks past the take profit check the exchange once per interval
+func TestTicksPastRestingTakeProfit(t *testing.T) {
+	exmo, _ := newTestExmo(t, map[string][]ExmoCandle{"ETC_USDT": hourlyCandles(20, 19, 19)})
+	engine := newTestEngine(t, exmo, testStrategy("ETC_USDT", Short))
+	engine.checkForOpen(engine.Strategies)
+	if !engine.isOrderOpened() || engine.OpenedOrder.TakeProfitOrderId == 0 {
+		t.Fatalf("opened %t, take profit %d", engine.isOrderOpened(), engine.OpenedOrder.TakeProfitOrderId)
+	}
+
+	requests := atomic.LoadInt64(&exmo.Stats.Requests)
+	engine.checkExitOrders()
+	check := atomic.LoadInt64(&exmo.Stats.Requests) - requests
+
+	requests = atomic.LoadInt64(&exmo.Stats.Requests)
+	for i := 0; i < 50; i++ {
+		engine.onTick("ETC_USDT", 15, 1, time.Now(), true)
+	}
+	if ticks := atomic.LoadInt64(&exmo.Stats.Requests) - requests; ticks != check || check == 0 {
+		t.Errorf("50 ticks made %d requests, one check is %d", ticks, check)
+	}
+	if !engine.isOrderOpened() {
+		t.Error("closed by the ticks while the take profit rests")
+	}
+}
@@ -3,23 +3,23 @@ module ExchangeBot
 go 1.18
 
 require (
+	github.com/adshao/go-binance/v2 v2.3.10
 	github.com/fatih/color v1.13.0
 	github.com/go-co-op/gocron v1.15.0
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/gorilla/websocket v1.5.0
 	github.com/joho/godotenv v1.4.0
 	gonum.org/v1/plot v0.11.0
 )
 
 require (
 	git.sr.ht/~sbinet/gg v0.3.1 // indirect
-	github.com/adshao/go-binance/v2 v2.3.10 // indirect
 	github.com/ajstarks/svgo v0.0.0-20211024235047-1546f124cd8b // indirect
 	github.com/bitly/go-simplejson v0.5.0 // indirect
 	github.com/go-fonts/liberation v0.2.0 // indirect
 	github.com/go-latex/latex v0.0.0-20210823091927-c0d11ff05a81 // indirect
 	github.com/go-pdf/fpdf v0.6.0 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/mattn/go-colorable v0.1.9 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
@@ -18,22 +18,108 @@ func getStrategy(str string) Strategy {
 	p := strings.Fields(str)
 
 	ind := func(t, b, c string) Indicator {
-		return Indicator{
+		indicator := Indicator{
 			IndicatorType: IndicatorType(toInt(t)),
 			BarType:       BarType(0).value(b),
 			Coef:          toInt(c),
 		}
+		if indicator.IndicatorType < IndicatorTypeSma || indicator.IndicatorType > maxIndicatorType ||
+			indicator.Coef < 1 {
+			log.Fatalf("unknown indicator %s %s %s", t, b, c)
+		}
+		return indicator
+	}
+
+	strategy := Strategy{
+		Pair:       p[0],
+		Resolution: getResolution(p[13:]),
+		Type:       NoStrategyType.value(p[1]),
+		Op:         toInt(p[2]),
+		Ind1:       ind(p[6], p[7], p[8]),
+		Tp:         toInt(p[3]),
+		Ind2:       ind(p[10], p[11], p[12]),
+		Sl:         toInt(p[4]),
+		Entry:      getEntry(p[13:]),
+		Trailing:   getTrailing(p[13:]),
+		Volume:     getVolumeFilter(p[13:]),
+	}
+	if depth := strategy.historyDepth(); int64(depth) > historyCandles {
+		log.Fatalf("%s needs %d candles of history, history.candles is %d", str, depth, historyCandles)
+	}
+	return strategy
+}
+
+// getVolumeFilter parses optional "volume=1.5 volsma=20", the volume average of 20 candles by default
+func getVolumeFilter(options []string) VolumeFilter {
+	filter := VolumeFilter{Period: 20}
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "volume":
+			filter.Ratio = s2f(value)
+		case "volsma":
+			filter.Period = toInt(value)
+		}
 	}
+	if filter.Period < 1 {
+		log.Fatalf("unknown volume average %d", filter.Period)
+	}
+	return filter
+}
+
+// getTrailing parses optional "trail=3% | trail=2atr atr=14 step=50"
+func getTrailing(options []string) Trailing {
+	trailing := Trailing{Period: 14, Step: 50}
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "trail":
+			if strings.HasSuffix(value, "%") {
+				trailing.Type, trailing.Value = TrailingPercent, s2f(strings.TrimSuffix(value, "%"))
+			} else if strings.HasSuffix(value, "atr") {
+				trailing.Type, trailing.Value = TrailingAtr, s2f(strings.TrimSuffix(value, "atr"))
+			}
+		case "atr":
+			trailing.Period = toInt(value)
+		case "step":
+			trailing.Step = toInt(value)
+		}
+	}
+	return trailing
+}
 
-	return Strategy{
-		Pair: p[0],
-		Type: NoStrategyType.value(p[1]),
-		Op:   toInt(p[2]),
-		Ind1: ind(p[6], p[7], p[8]),
-		Tp:   toInt(p[3]),
-		Ind2: ind(p[10], p[11], p[12]),
-		Sl:   toInt(p[4]),
+// getResolution parses optional "resolution=1|5|15|30|60|240|D", hourly candles by default
+func getResolution(options []string) Resolution {
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		if key == "resolution" {
+			resolution := Resolution(strings.ToUpper(value))
+			if !resolution.isValid() {
+				log.Fatalf("unknown resolution %s", value)
+			}
+			return resolution
+		}
 	}
+	return defaultResolution
+}
+
+// getEntry parses optional "entry=bid|open|market offset=-10 timeout=60 fallback=market|none"
+func getEntry(options []string) Entry {
+	entry := Entry{Timeout: 60, Fallback: true}
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "entry":
+			entry.Type = EntryMarket.value(value)
+		case "offset":
+			entry.Offset = toInt(value)
+		case "timeout":
+			entry.Timeout = toInt(value)
+		case "fallback":
+			entry.Fallback = value == "market"
+		}
+	}
+	return entry
 }
 
 func toInt(str string) int {
@@ -115,6 +201,11 @@ func f2s(x float64) string {
 	return fmt.Sprintf("%v", x)
 }
 
+// formatFloat never uses the exponent notation of f2s, exchanges do not accept "1e-05"
+func formatFloat(x float64, decimals int) string {
+	return strconv.FormatFloat(x, 'f', decimals, 64)
+}
+
 func s2f(s string) float64 {
 	f, _ := strconv.ParseFloat(s, 64)
 	return f
@@ -144,19 +235,43 @@ func getRightCurrency(pair string) Currency {
 	return currency
 }
 
+// getUniqueStrategies keeps one strategy for every candle series: pair and resolution
 func getUniqueStrategies(strategies []Strategy) []Strategy {
 	var uniqueStrategies []Strategy
 	var symbols []string
 	for _, strategy := range strategies {
-		pair := strategy.Pair
-		if sliceIndex(symbols, pair) == -1 {
-			symbols = append(symbols, pair)
+		key := candleKey(strategy.Exchange, strategy.Pair, strategy.Resolution)
+		if sliceIndex(symbols, key) == -1 {
+			symbols = append(symbols, key)
 			uniqueStrategies = append(uniqueStrategies, strategy)
 		}
 	}
 	return uniqueStrategies
 }
 
+func getUniquePairs(strategies []Strategy) []string {
+	var pairs []string
+	for _, strategy := range strategies {
+		if sliceIndex(pairs, strategy.Pair) == -1 {
+			pairs = append(pairs, strategy.Pair)
+		}
+	}
+	return pairs
+}
+
+// groupByResolution keeps the order of the first appearance of every resolution
+func groupByResolution(strategies []Strategy) ([]Resolution, map[Resolution][]Strategy) {
+	var resolutions []Resolution
+	groups := make(map[Resolution][]Strategy)
+	for _, strategy := range strategies {
+		if _, ok := groups[strategy.Resolution]; !ok {
+			resolutions = append(resolutions, strategy.Resolution)
+		}
+		groups[strategy.Resolution] = append(groups[strategy.Resolution], strategy)
+	}
+	return resolutions, groups
+}
+
 func sliceIndex[E comparable](s []E, v E) int {
 	for i, vs := range s {
 		if v == vs {
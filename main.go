@@ -10,62 +10,41 @@ import (
 	"gonum.org/v1/plot/vg/draw"
 	"image/color"
 	"log"
+	"math"
 	"math/rand"
 	"os"
-	"strings"
 	"time"
 )
 
 var scheduler *gocron.Scheduler
 
-var exchange string
-
-var apiHandler ApiInterface
-
 func init() {
 	rand.Seed(time.Now().UnixNano())
 
 	_ = godotenv.Load()
-	exchange = os.Getenv("exchange")
-
-	switch exchange {
-	case "exmo":
-		apiHandler = exmo.init()
-	//case "binance":
-	//	apiHandler = binance.init()
-	default:
-		log.Fatal("NO HANDLER")
+	if depth := s2i(os.Getenv("history.candles")); depth > 0 {
+		historyCandles = depth
 	}
-
-	apiHandler.showBalance()
-
-	tgBot.init()
-	CandleStorage = make(map[string]CandleData)
+	fillCandleGaps = os.Getenv("candles.gaps") == "fill"
+	CandleStorage = newCandleRepository()
 }
 
 func main() {
-	envParams := os.Getenv("params")
-	if envParams != "" {
-		params := strings.Split(envParams, "}{")
-		params[0] = params[0][1:]
-		params[len(params)-1] = params[len(params)-1][:len(params[len(params)-1])-1]
-		var strategies []Strategy
-
-		scheduler = gocron.NewScheduler(time.UTC)
-		scheduler.StartAsync()
-
-		for _, param := range params {
-			strategy := getStrategy(param)
-			strategies = append(strategies, strategy)
-		}
-		apiHandler.downloadHistoryCandlesForStrategies(getUniqueStrategies(strategies))
-		apiHandler.listenCandles(strategies)
+	accounts = loadAccounts()
+
+	scheduler = gocron.NewScheduler(time.UTC)
+	scheduler.StartAsync()
 
+	for _, account := range accounts {
+		account.run()
 	}
 
 	select {}
 }
 
+// chartCandles is the number of the last candles on the order screenshot
+const chartCandles = 60
+
 func (candleData *CandleData) drawBars(tp, sl float64) string {
 	c := candleData.Candles
 
@@ -73,9 +52,11 @@ func (candleData *CandleData) drawBars(tp, sl float64) string {
 	green := color.NRGBA{R: 109, G: 195, B: 88, A: 255}
 	gray := color.NRGBA{R: 22, G: 26, B: 37, A: 255}
 	blue := color.NRGBA{G: 160, B: 240, A: 255}
+	redVolume := color.NRGBA{R: 255, G: 108, B: 101, A: 96}
+	greenVolume := color.NRGBA{R: 109, G: 195, B: 88, A: 96}
 	p := plot.New()
 	p.BackgroundColor = gray
-	p.X.Max = 62
+	p.X.Max = chartCandles + 2
 	p.X.Min = -1
 	p.X.Tick.Color = blue
 	p.X.Tick.Label.Color = blue
@@ -91,8 +72,23 @@ func (candleData *CandleData) drawBars(tp, sl float64) string {
 		Width:  vg.Points(2),
 		Dashes: []vg.Length{},
 	}
-	const cnt = 60
-	startI := candleData.len() - cnt
+	// молодая пара или короткая история рисуется как есть
+	startI := candleData.len() - chartCandles
+	if startI < 0 {
+		startI = 0
+	}
+	cnt := candleData.len() - startI
+
+	// объёмы рисуются под свечами, самый большой занимает пятую часть диапазона цен
+	low, high, maxVolume := math.Inf(1), math.Inf(-1), 0.0
+	for i := startI; i < candleData.len(); i++ {
+		low = math.Min(low, c[L][i])
+		high = math.Max(high, c[H][i])
+		maxVolume = math.Max(maxVolume, c[V][i])
+	}
+	volumeHeight := (high - low) / 5
+	volumeBase := low - volumeHeight
+
 	var xTicks []plot.Tick
 	for i := 0; i < cnt; i++ {
 		lo := c[L][startI+i]
@@ -118,6 +114,15 @@ func (candleData *CandleData) drawBars(tp, sl float64) string {
 			bar.BoxStyle.Color = red
 			bar.MedianStyle.Color = red
 		}
+		if maxVolume > 0 {
+			top := volumeBase + c[V][startI+i]/maxVolume*volumeHeight
+			volume, _ := plotter.NewLine(plotter.XYs{{X: float64(i), Y: volumeBase}, {X: float64(i), Y: top}})
+			volume.LineStyle = draw.LineStyle{Color: redVolume, Width: w}
+			if cl >= op {
+				volume.LineStyle.Color = greenVolume
+			}
+			p.Add(volume)
+		}
 		if (i+1)%4 == 0 {
 			xTicks = append(xTicks, plot.Tick{Value: float64(i), Label: candleData.Time[startI+i].Format("15:04")})
 		}
@@ -129,7 +134,7 @@ func (candleData *CandleData) drawBars(tp, sl float64) string {
 
 	lineFn := func(level float64, clr color.RGBA) *plotter.Line {
 		return &plotter.Line{
-			XYs: []plotter.XY{{X: float64(cnt + 2), Y: level}, {X: float64(cnt), Y: level}},
+			XYs: []plotter.XY{{X: float64(chartCandles + 2), Y: level}, {X: float64(chartCandles), Y: level}},
 			LineStyle: draw.LineStyle{
 				Color:    clr,
 				Width:    vg.Points(3),
@@ -144,7 +149,7 @@ func (candleData *CandleData) drawBars(tp, sl float64) string {
 
 	folder := fmt.Sprintf("./screens/%s", time.Now().Format("06/01/02"))
 	_ = os.MkdirAll(folder, 0755)
-	path := fmt.Sprintf("%s/%s_%s_%s.png", folder, candleData.Pair, resolution, time.Now().Format("1504"))
+	path := fmt.Sprintf("%s/%s_%s_%s.png", folder, candleData.Pair, candleData.Resolution, time.Now().Format("1504"))
 	err := p.Save(1200, 600, path)
 
 	if err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// MarginBook is the margin wallet of the paper trading and of the fake exmo server. Positions are signed coins
+// of the pair: a sell without coins opens a short, the buys close it. Money is settled in the balances of the caller,
+// orders do not reserve anything, the exchange checks the collateral when a position grows
+type MarginBook struct {
+	Positions map[string]float64
+	Orders    map[int64]MarginOrder
+	Trades    map[string][]ExmoTrade
+}
+
+// MarginOrder is a resting order: limit_buy, limit_sell, stop_buy or stop_sell
+type MarginOrder struct {
+	ClientId     int64
+	Pair         string
+	Type         string
+	Quantity     float64
+	Price        float64
+	TriggerPrice float64
+	Created      int64
+}
+
+var (
+	errMarginFunds = errors.New("insufficient funds")
+	errMarginType  = errors.New("unsupported order type")
+)
+
+// marginTradesHistory is the number of last trades kept for every pair
+const marginTradesHistory = 100
+
+func newMarginBook() *MarginBook {
+	return &MarginBook{
+		Positions: make(map[string]float64),
+		Orders:    make(map[int64]MarginOrder),
+		Trades:    make(map[string][]ExmoTrade),
+	}
+}
+
+// side is "buy" or "sell" of every order type
+func (order MarginOrder) side() string {
+	switch order.Type {
+	case "market_buy", "limit_buy", "stop_buy":
+		return "buy"
+	}
+	return "sell"
+}
+
+// create fills market orders and limit orders crossed by the price at once, the others rest in the book.
+// The money has to cover the grown position with the leverage
+func (book *MarginBook) create(money Balances, id int64, order MarginOrder, price, leverage, fee float64) error {
+	switch order.Type {
+	case "market_buy", "market_sell", "limit_buy", "limit_sell", "stop_buy", "stop_sell":
+	default:
+		return errMarginType
+	}
+	if order.Quantity <= 0 || price <= 0 || leverage <= 0 {
+		return errMarginFunds
+	}
+	position := book.Positions[order.Pair]
+	grows := order.side() == "buy" && position >= 0 || order.side() == "sell" && position <= 0
+	if grows && money.available(getRightCurrency(order.Pair))*leverage < order.Quantity*price {
+		return errMarginFunds
+	}
+
+	switch {
+	case order.Type == "market_buy" || order.Type == "market_sell",
+		order.Type == "limit_buy" && price <= order.Price,
+		order.Type == "limit_sell" && price >= order.Price:
+		book.fill(money, id, order, price, fee)
+	default:
+		order.Created = time.Now().Unix()
+		book.Orders[id] = order
+	}
+	return nil
+}
+
+// trigger fills the orders of the pair reached by the prices, open is the first price of the period
+func (book *MarginBook) trigger(money Balances, pair string, open, high, low, fee float64) int {
+	filled := 0
+	for id, order := range book.Orders {
+		if order.Pair != pair {
+			continue
+		}
+		var price float64
+		switch {
+		case order.Type == "limit_buy" && low <= order.Price:
+			price = math.Min(order.Price, open)
+		case order.Type == "limit_sell" && high >= order.Price:
+			price = math.Max(order.Price, open)
+		case order.Type == "stop_buy" && high >= order.TriggerPrice:
+			price = math.Max(order.TriggerPrice, open)
+		case order.Type == "stop_sell" && low <= order.TriggerPrice:
+			price = math.Min(order.TriggerPrice, open)
+		default:
+			continue
+		}
+		delete(book.Orders, id)
+		book.fill(money, id, order, price, fee)
+		filled++
+	}
+	return filled
+}
+
+// fill moves the position and the money, buys pay the fee in coins like the spot ones
+func (book *MarginBook) fill(money Balances, id int64, order MarginOrder, price, fee float64) {
+	right := getRightCurrency(order.Pair)
+	side := order.side()
+	if side == "buy" {
+		money.add(right, -order.Quantity*price, 0)
+		book.Positions[order.Pair] += order.Quantity * (1 - fee)
+	} else {
+		money.add(right, order.Quantity*price*(1-fee), 0)
+		book.Positions[order.Pair] -= order.Quantity
+	}
+	if math.Abs(book.Positions[order.Pair]) < 1e-8 {
+		delete(book.Positions, order.Pair)
+	}
+
+	trades := append(book.Trades[order.Pair], ExmoTrade{
+		TradeID:          int64(len(book.Trades[order.Pair]) + 1),
+		Date:             time.Now().Unix(),
+		Type:             side,
+		Pair:             order.Pair,
+		OrderID:          id,
+		ClientID:         order.ClientId,
+		Quantity:         order.Quantity,
+		Price:            price,
+		Amount:           order.Quantity * price,
+		CommissionAmount: order.Quantity * price * fee,
+	})
+	if len(trades) > marginTradesHistory {
+		trades = trades[len(trades)-marginTradesHistory:]
+	}
+	book.Trades[order.Pair] = trades
+}
+
+func (book *MarginBook) cancel(id int64) bool {
+	if _, ok := book.Orders[id]; !ok {
+		return false
+	}
+	delete(book.Orders, id)
+	return true
+}
+
+func (book *MarginBook) openOrders() []ExmoMarginOrder {
+	orders := []ExmoMarginOrder{}
+	for id, order := range book.Orders {
+		orders = append(orders, ExmoMarginOrder{
+			OrderID:      id,
+			ClientID:     order.ClientId,
+			Created:      order.Created,
+			Type:         order.Type,
+			Pair:         order.Pair,
+			Quantity:     order.Quantity,
+			Price:        order.Price,
+			TriggerPrice: order.TriggerPrice,
+		})
+	}
+	return orders
+}
+
+// trades returns the latest trades of the pair first
+func (book *MarginBook) trades(pair string, limit int) []ExmoTrade {
+	trades := []ExmoTrade{}
+	for i := len(book.Trades[pair]) - 1; i >= 0 && len(trades) < limit; i-- {
+		trades = append(trades, book.Trades[pair][i])
+	}
+	return trades
+}
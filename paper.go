@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/fatih/color"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PaperWallet simulates exchange orders: prices come from real candles, balances are kept locally.
+type PaperWallet struct {
+	Balance     Balances
+	StopLosses  map[int64]PaperStopOrder
+	Orders      map[int64]PaperOrder
+	Trades      map[int64][]ExmoTrade
+	Margin      *MarginBook
+	Fee         float64
+	LastOrderId int64
+	account     string
+}
+
+type PaperStopOrder struct {
+	Pair         string
+	Type         string
+	Quantity     float64
+	TriggerPrice float64
+}
+
+// PaperOrder is a limit order that was not filled at once, the money of a buy and the coins of a sell are reserved
+type PaperOrder struct {
+	Pair     string
+	Type     string
+	Quantity float64
+	Price    float64
+	Created  time.Time
+}
+
+// paperTradesHistory is the number of last orders whose trades are kept
+const paperTradesHistory = 100
+
+func (exmo *Exmo) initPaper(account *Account) *Exmo {
+	exmo.Account = account.Name
+	exmo.initClient(account.setting("exmo.url"), time.Duration(s2i(account.setting("exmo.timeout")))*time.Second, nil)
+	exmo.initStream(account.setting("exmo.stream"))
+	if _, err := exmo.apiGetPairSettings(); err != nil {
+		log.Fatalln(err)
+	}
+	exmo.Wallet = newPaperWallet(account.env("paper.balance"), s2f(account.setting("paper.fee")))
+	exmo.Wallet.account = account.Name
+	exmo.Wallet.restore()
+
+	return exmo
+}
+
+// newPaperWallet parses balances like "USDT:1000,ETC:2", fee is in percents
+func newPaperWallet(balance string, fee float64) *PaperWallet {
+	wallet := &PaperWallet{
+		Balance:    make(Balances),
+		StopLosses: make(map[int64]PaperStopOrder),
+		Orders:     make(map[int64]PaperOrder),
+		Trades:     make(map[int64][]ExmoTrade),
+		Margin:     newMarginBook(),
+		Fee:        fee / 100,
+	}
+	for _, item := range strings.Split(balance, ",") {
+		kv := strings.Split(strings.TrimSpace(item), ":")
+		if len(kv) == 2 {
+			wallet.Balance.add(Currency(kv[0]), s2f(kv[1]), 0)
+		}
+	}
+	return wallet
+}
+
+func (wallet *PaperWallet) restore() bool {
+	fileName := wallet.getFileName()
+	if !fileExists(fileName) {
+		return false
+	}
+	fee := wallet.Fee
+	dataIn := ReadFromFile(fileName)
+	dec := gob.NewDecoder(bytes.NewReader(dataIn))
+	_ = dec.Decode(wallet)
+	wallet.Fee = fee
+	if wallet.StopLosses == nil {
+		wallet.StopLosses = make(map[int64]PaperStopOrder)
+	}
+	if wallet.Orders == nil {
+		wallet.Orders = make(map[int64]PaperOrder)
+	}
+	if wallet.Trades == nil {
+		wallet.Trades = make(map[int64][]ExmoTrade)
+	}
+	if wallet.Margin == nil {
+		wallet.Margin = newMarginBook()
+	}
+
+	return true
+}
+
+func (wallet *PaperWallet) backup() {
+	dataOut := EncodeToBytes(wallet)
+	_ = os.WriteFile(wallet.getFileName(), dataOut, 0644)
+}
+
+func (wallet *PaperWallet) getFileName() string {
+	return accountFileName(wallet.account, "paper_wallet.dat")
+}
+
+func (wallet *PaperWallet) createOrder(params ApiParams, price float64) (OrderResponse, error) {
+	const method = "order_create"
+
+	pair := params["pair"]
+	left, right := getCurrencies(pair)
+	quantity := s2f(params["quantity"])
+	if price <= 0 {
+		return OrderResponse{}, &ExmoError{Method: method, Message: "paper: no price for " + pair}
+	}
+
+	switch params["type"] {
+	case "market_buy_total":
+		if quantity <= 0 || wallet.Balance.available(right) < quantity {
+			return OrderResponse{}, wallet.insufficientFunds(method, right, quantity)
+		}
+		wallet.Balance.add(right, -quantity, 0)
+		wallet.Balance.add(left, quantity/price*(1-wallet.Fee), 0)
+		wallet.LastOrderId++
+		wallet.addTrade(wallet.LastOrderId, 0, pair, "buy", quantity/price, price)
+	case "market_sell":
+		if quantity <= 0 || wallet.Balance.available(left) < quantity {
+			return OrderResponse{}, wallet.insufficientFunds(method, left, quantity)
+		}
+		wallet.Balance.add(left, -quantity, 0)
+		wallet.Balance.add(right, quantity*price*(1-wallet.Fee), 0)
+		wallet.LastOrderId++
+		wallet.addTrade(wallet.LastOrderId, 0, pair, "sell", quantity, price)
+	case "market_buy":
+		if quantity <= 0 || wallet.Balance.available(right) < quantity*price {
+			return OrderResponse{}, wallet.insufficientFunds(method, right, quantity*price)
+		}
+		wallet.Balance.add(right, -quantity*price, 0)
+		wallet.Balance.add(left, quantity*(1-wallet.Fee), 0)
+		wallet.LastOrderId++
+		wallet.addTrade(wallet.LastOrderId, 0, pair, "buy", quantity, price)
+	case "buy":
+		// the limit buy is filled at once when the market is not higher, otherwise it waits for cancellation
+		limitPrice := s2f(params["price"])
+		if quantity <= 0 || wallet.Balance.available(right) < quantity*limitPrice {
+			return OrderResponse{}, wallet.insufficientFunds(method, right, quantity*limitPrice)
+		}
+		wallet.LastOrderId++
+		if price <= limitPrice {
+			wallet.Balance.add(right, -quantity*price, 0)
+			wallet.Balance.add(left, quantity*(1-wallet.Fee), 0)
+			wallet.addTrade(wallet.LastOrderId, 0, pair, "buy", quantity, price)
+		} else {
+			wallet.Balance.add(right, -quantity*limitPrice, quantity*limitPrice)
+			wallet.Orders[wallet.LastOrderId] = PaperOrder{Pair: pair, Type: "buy", Quantity: quantity, Price: limitPrice, Created: time.Now()}
+		}
+	case "sell":
+		limitPrice := s2f(params["price"])
+		if quantity <= 0 || wallet.Balance.available(left) < quantity {
+			return OrderResponse{}, wallet.insufficientFunds(method, left, quantity)
+		}
+		wallet.LastOrderId++
+		if price >= limitPrice {
+			wallet.Balance.add(left, -quantity, 0)
+			wallet.Balance.add(right, quantity*price*(1-wallet.Fee), 0)
+			wallet.addTrade(wallet.LastOrderId, 0, pair, "sell", quantity, price)
+		} else {
+			wallet.Balance.add(left, -quantity, quantity)
+			wallet.Orders[wallet.LastOrderId] = PaperOrder{Pair: pair, Type: "sell", Quantity: quantity, Price: limitPrice, Created: time.Now()}
+		}
+	default:
+		return OrderResponse{}, &ExmoError{Method: method, Message: "paper: unsupported order type " + params["type"]}
+	}
+
+	wallet.backup()
+
+	return OrderResponse{Result: true, OrderID: int(wallet.LastOrderId)}, nil
+}
+
+func (wallet *PaperWallet) addTrade(orderId, parentOrderId int64, pair, tradeType string, quantity, price float64) {
+	wallet.Trades[orderId] = append(wallet.Trades[orderId], ExmoTrade{
+		Date:             time.Now().Unix(),
+		Type:             tradeType,
+		Pair:             pair,
+		OrderID:          orderId,
+		ParentOrderID:    parentOrderId,
+		Quantity:         quantity,
+		Price:            price,
+		Amount:           quantity * price,
+		CommissionAmount: quantity * price * wallet.Fee,
+	})
+	delete(wallet.Trades, orderId-paperTradesHistory)
+}
+
+func (wallet *PaperWallet) cancelOrder(orderId int64) error {
+	order, ok := wallet.Orders[orderId]
+	if !ok {
+		return &ExmoError{Code: ExmoErrorOrderNotFound, Message: "paper: order was not found", Method: "order_cancel"}
+	}
+	if order.isSell() {
+		wallet.Balance.add(getLeftCurrency(order.Pair), order.Quantity, -order.Quantity)
+	} else {
+		amount := order.Quantity * order.Price
+		wallet.Balance.add(getRightCurrency(order.Pair), amount, -amount)
+	}
+	delete(wallet.Orders, orderId)
+	wallet.backup()
+
+	return nil
+}
+
+func (wallet *PaperWallet) orderTrades(orderId int64) OrderTradesResponse {
+	return OrderTradesResponse{Trades: wallet.Trades[orderId]}
+}
+
+func (wallet *PaperWallet) openOrders() OpenOrdersResponse {
+	orders := make(OpenOrdersResponse)
+	for id, order := range wallet.Orders {
+		orders[order.Pair] = append(orders[order.Pair], ExmoOpenOrder{
+			OrderID:  id,
+			Created:  order.Created.Unix(),
+			Type:     order.side(),
+			Pair:     order.Pair,
+			Quantity: order.Quantity,
+			Price:    order.Price,
+			Amount:   order.Quantity * order.Price,
+		})
+	}
+	for id, stopOrder := range wallet.StopLosses {
+		orders[stopOrder.Pair] = append(orders[stopOrder.Pair], ExmoOpenOrder{
+			ParentOrderID: id,
+			Type:          stopOrder.side(),
+			Pair:          stopOrder.Pair,
+			Quantity:      stopOrder.Quantity,
+			TriggerPrice:  stopOrder.TriggerPrice,
+		})
+	}
+	return orders
+}
+
+func (wallet *PaperWallet) insufficientFunds(method string, currency Currency, quantity float64) error {
+	return &ExmoError{
+		Code:    ExmoErrorInsufficientFunds,
+		Message: fmt.Sprintf("paper: insufficient funds %s %f", currency, quantity),
+		Method:  method,
+	}
+}
+
+// createStopLoss reserves the coins of a sell stop, buy stops pay when triggered
+func (wallet *PaperWallet) createStopLoss(pair, orderType string, quantity, triggerPrice float64) (StopOrderResponse, error) {
+	left := getLeftCurrency(pair)
+	if orderType == "sell" {
+		if quantity <= 0 || wallet.Balance.available(left) < quantity {
+			return StopOrderResponse{}, wallet.insufficientFunds("stop_market_order_create", left, quantity)
+		}
+		wallet.Balance.add(left, -quantity, quantity)
+	}
+
+	wallet.LastOrderId++
+	wallet.StopLosses[wallet.LastOrderId] = PaperStopOrder{
+		Pair:         pair,
+		Type:         orderType,
+		Quantity:     quantity,
+		TriggerPrice: triggerPrice,
+	}
+	wallet.backup()
+
+	return StopOrderResponse{ParentOrderID: wallet.LastOrderId}, nil
+}
+
+func (wallet *PaperWallet) cancelStopLoss(parentOrderId int64) error {
+	stopOrder, ok := wallet.StopLosses[parentOrderId]
+	if !ok {
+		return &ExmoError{Code: ExmoErrorOrderNotFound, Message: "paper: order was not found", Method: "stop_market_order_cancel"}
+	}
+	if !stopOrder.isBuy() {
+		wallet.Balance.add(getLeftCurrency(stopOrder.Pair), stopOrder.Quantity, -stopOrder.Quantity)
+	}
+	delete(wallet.StopLosses, parentOrderId)
+	wallet.backup()
+
+	return nil
+}
+
+// triggerOrders executes the stops first and the limit orders then, inside the candle the order of prices is unknown.
+// The fills are found by the engine in the trades
+func (wallet *PaperWallet) triggerOrders(pair string, candle Candle) {
+	wallet.triggerStopLosses(pair, candle)
+	wallet.fillOrders(pair, candle)
+	if wallet.Margin.trigger(wallet.Balance, pair, candle.O, candle.H, candle.L, wallet.Fee) > 0 {
+		color.HiGreen("PAPER margin orders filled %s", pair)
+		wallet.backup()
+	}
+}
+
+// triggerStopLosses sells the reserved coins of every sell stop reached by the candle low
+// and buys coins of every buy stop reached by the candle high
+func (wallet *PaperWallet) triggerStopLosses(pair string, candle Candle) {
+	triggered := 0
+	for id, stopOrder := range wallet.StopLosses {
+		if stopOrder.Pair != pair {
+			continue
+		}
+		left, right := getCurrencies(pair)
+		price := stopOrder.TriggerPrice
+		if stopOrder.isBuy() {
+			if candle.H < stopOrder.TriggerPrice {
+				continue
+			}
+			price = math.Max(price, candle.O)
+			wallet.Balance.add(right, -stopOrder.Quantity*price, 0)
+			wallet.Balance.add(left, stopOrder.Quantity*(1-wallet.Fee), 0)
+		} else {
+			if candle.L > stopOrder.TriggerPrice {
+				continue
+			}
+			price = math.Min(price, candle.O)
+			wallet.Balance.add(left, 0, -stopOrder.Quantity)
+			wallet.Balance.add(right, stopOrder.Quantity*price*(1-wallet.Fee), 0)
+		}
+		delete(wallet.StopLosses, id)
+		triggered++
+		wallet.LastOrderId++
+		wallet.addTrade(wallet.LastOrderId, id, pair, stopOrder.side(), stopOrder.Quantity, price)
+		color.HiRed("PAPER stopLoss %d triggered %s %f", id, pair, price)
+	}
+	if triggered > 0 {
+		wallet.backup()
+	}
+}
+
+// fillOrders fills limit buys reached by the candle low and limit sells reached by the candle high
+// with the reserved money or coins
+func (wallet *PaperWallet) fillOrders(pair string, candle Candle) {
+	filled := 0
+	for id, order := range wallet.Orders {
+		if order.Pair != pair {
+			continue
+		}
+		left, right := getCurrencies(pair)
+		price := order.Price
+		if order.isSell() {
+			if candle.H < order.Price {
+				continue
+			}
+			price = math.Max(price, candle.O)
+			wallet.Balance.add(left, 0, -order.Quantity)
+			wallet.Balance.add(right, order.Quantity*price*(1-wallet.Fee), 0)
+		} else {
+			if candle.L > order.Price {
+				continue
+			}
+			price = math.Min(price, candle.O)
+			wallet.Balance.add(right, order.Quantity*(order.Price-price), -order.Quantity*order.Price)
+			wallet.Balance.add(left, order.Quantity*(1-wallet.Fee), 0)
+		}
+		delete(wallet.Orders, id)
+		filled++
+		wallet.addTrade(id, 0, pair, order.side(), order.Quantity, price)
+		color.HiGreen("PAPER order %d filled %s %s %f", id, pair, order.side(), price)
+	}
+	if filled > 0 {
+		wallet.backup()
+	}
+}
+
+// isSell is false for orders saved before take profits were supported
+func (order PaperOrder) isSell() bool {
+	return order.Type == "sell"
+}
+
+func (order PaperOrder) side() string {
+	if order.isSell() {
+		return "sell"
+	}
+	return "buy"
+}
+
+// isBuy is false for stops saved before shorts were supported
+func (stopOrder PaperStopOrder) isBuy() bool {
+	return stopOrder.Type == "buy"
+}
+
+func (stopOrder PaperStopOrder) side() string {
+	if stopOrder.isBuy() {
+		return "buy"
+	}
+	return "sell"
+}
+
+// createMarginOrder places the order in the margin book, the money of the wallet is its collateral.
+// Orders that are not filled at once are compared with the candles
+func (wallet *PaperWallet) createMarginOrder(params ApiParams, price float64) (int64, error) {
+	const method = "margin/user/order/create"
+
+	order := MarginOrder{
+		Pair:         params["pair"],
+		Type:         params["type"],
+		Quantity:     s2f(params["quantity"]),
+		Price:        s2f(params["price"]),
+		TriggerPrice: s2f(params["trigger_price"]),
+	}
+	if price <= 0 {
+		// nothing was traded lately, only one of the prices is set by the type
+		price = order.Price + order.TriggerPrice
+	}
+
+	err := wallet.Margin.create(wallet.Balance, wallet.LastOrderId+1, order, price, s2f(params["leverage"]), wallet.Fee)
+	switch err {
+	case nil:
+	case errMarginFunds:
+		return 0, wallet.insufficientFunds(method, getRightCurrency(order.Pair), order.Quantity*price)
+	default:
+		return 0, &ExmoError{Method: method, Message: "paper: " + err.Error() + " " + order.Type}
+	}
+	wallet.LastOrderId++
+	wallet.backup()
+
+	return wallet.LastOrderId, nil
+}
+
+func (wallet *PaperWallet) cancelMarginOrder(orderId int64) error {
+	if !wallet.Margin.cancel(orderId) {
+		return &ExmoError{Code: ExmoErrorOrderNotFound, Message: "paper: order was not found", Method: "margin/user/order/cancel"}
+	}
+	wallet.backup()
+
+	return nil
+}
+
+// trades returns the latest trades of the pair first
+func (wallet *PaperWallet) trades(pair string, limit int) []ExmoTrade {
+	var trades []ExmoTrade
+	for _, orderTrades := range wallet.Trades {
+		for _, trade := range orderTrades {
+			if trade.Pair == pair {
+				trades = append(trades, trade)
+			}
+		}
+	}
+	sort.Slice(trades, func(i, j int) bool { return trades[i].OrderID > trades[j].OrderID })
+	if len(trades) > limit {
+		trades = trades[:limit]
+	}
+	return trades
+}
+
+func (wallet *PaperWallet) String() string {
+	return "PAPER " + wallet.Balance.String()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by all requests to one exchange
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available and takes it, returns true if the caller was throttled
+func (limiter *RateLimiter) wait() bool {
+	limiter.Lock()
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+	limiter.tokens--
+	delay := time.Duration(0)
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+		return true
+	}
+	return false
+}
+
+type ApiStats struct {
+	Requests  int64
+	Retries   int64
+	Failures  int64
+	Throttled int64
+}
+
+func (stats *ApiStats) String() string {
+	return fmt.Sprintf("requests:%d retries:%d failures:%d throttled:%d",
+		atomic.LoadInt64(&stats.Requests),
+		atomic.LoadInt64(&stats.Retries),
+		atomic.LoadInt64(&stats.Failures),
+		atomic.LoadInt64(&stats.Throttled),
+	)
+}
+
+type HttpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HttpStatusError) Error() string {
+	return "http status: " + e.Status
+}
+
+// isRetryable treats network errors, 5xx and 429 responses as temporary
+func isRetryable(err error) bool {
+	var statusError *HttpStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode == http.StatusTooManyRequests || statusError.StatusCode >= 500
+	}
+	var exmoError *ExmoError
+	return !errors.As(err, &exmoError)
+}
+
+type Backoff struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+var defaultBackoff = Backoff{
+	Attempts: 5,
+	Base:     500 * time.Millisecond,
+	Max:      30 * time.Second,
+}
+
+// delay is exponential with "equal jitter": half of the step is fixed, the other half is random
+func (backoff Backoff) delay(attempt int) time.Duration {
+	step := backoff.Base << attempt
+	if step > backoff.Max || step <= 0 {
+		step = backoff.Max
+	}
+	return step/2 + time.Duration(rand.Int63n(int64(step/2)+1))
+}
+
+// retry runs fn through the limiter until it succeeds, fails permanently or attempts are exhausted
+func (backoff Backoff) retry(limiter *RateLimiter, stats *ApiStats, name string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < backoff.Attempts; attempt++ {
+		if attempt > 0 {
+			delay := backoff.delay(attempt - 1)
+			atomic.AddInt64(&stats.Retries, 1)
+			color.HiYellow("RETRY %s #%d in %s: %+v", name, attempt, delay, err)
+			time.Sleep(delay)
+		}
+
+		if limiter.wait() {
+			atomic.AddInt64(&stats.Throttled, 1)
+		}
+		atomic.AddInt64(&stats.Requests, 1)
+
+		if err = fn(); err == nil || !isRetryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.Failures, 1)
+	}
+	return err
+}
+
+// RetryTransport applies the limiter to every request and retries idempotent ones.
+// Sign renews the signature of a retried request, signed requests expire with their timestamp
+type RetryTransport struct {
+	Base    http.RoundTripper
+	Limiter *RateLimiter
+	Backoff Backoff
+	Stats   *ApiStats
+	Sign    func(req *http.Request) *http.Request
+}
+
+func (transport *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	backoff := transport.Backoff
+	if req.Method != http.MethodGet {
+		backoff.Attempts = 1
+	}
+
+	var resp *http.Response
+	attempt := 0
+	err := backoff.retry(transport.Limiter, transport.Stats, req.URL.Path, func() error {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		next := req
+		if attempt > 0 && transport.Sign != nil {
+			next = transport.Sign(req)
+		}
+		attempt++
+		var err error
+		resp, err = base.RoundTrip(next)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return &HttpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		return nil
+	})
+
+	var statusError *HttpStatusError
+	if errors.As(err, &statusError) {
+		// the client reads the error body of the last attempt itself
+		return resp, nil
+	}
+	return resp, err
+}
@@ -2,47 +2,141 @@ package main
 
 import (
 	"fmt"
+	"github.com/fatih/color"
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	"os"
+	"strings"
 )
 
-var tgBot TgBot
-
 type TgBot struct {
 	*tg.BotAPI
 	Channel int64
+	Tag     string
 }
 
-func (bot *TgBot) init() {
-	bot.BotAPI, _ = tg.NewBotAPI(os.Getenv("tg.token"))
-	bot.Channel = s2i(os.Getenv("tg.channel"))
-	bot.Debug = false
+// newTgBot posts to the channel of the account, named accounts are tagged by the name
+func newTgBot(account *Account) *TgBot {
+	bot := &TgBot{Channel: s2i(account.setting("tg.channel"))}
+	var err error
+	bot.BotAPI, err = tg.NewBotAPI(account.setting("tg.token"))
+	if err != nil {
+		color.HiRed("Telegram is disabled for %s: %+v", account, err)
+	} else {
+		bot.Debug = false
+	}
+
+	var tags []string
+	if account.Name != "" {
+		tags = append(tags, "#"+account.Name)
+	}
+	if account.Exchange == "paper" {
+		tags = append(tags, "#PAPER")
+	}
+	bot.Tag = strings.Join(tags, " ")
+
+	return bot
 }
 
-func (bot *TgBot) newOrderOpened(pair string, price, stopLossPrice float64, screen string) int {
-	msg := tg.NewPhoto(tgBot.Channel, tg.FilePath(screen))
-	msg.Caption = fmt.Sprintf("%s%s%s%s",
-		listFormat("Операция", "#BUY"),
-		listFormat("Пара", "#"+pair),
+func (bot *TgBot) newOrderOpened(strategy Strategy, price, stopLossPrice float64, screen string) int {
+	operation := "#BUY"
+	if strategy.isShort() {
+		operation = "#SHORT"
+	}
+	msg := tg.NewPhoto(bot.Channel, tg.FilePath(screen))
+	msg.Caption = fmt.Sprintf("%s%s%s%s%s",
+		bot.tagFormat(),
+		listFormat("Операция", operation),
+		listFormat("Пара", "#"+strategy.Pair),
 		listFormat("Цена", f2s(price)),
 		listFormat("SL", f2s(stopLossPrice)),
 	)
 	msg.ParseMode = tg.ModeHTML
-	result, _ := tgBot.Send(msg)
-
-	return result.MessageID
+	return bot.send(msg).MessageID
 }
 
-func (bot *TgBot) orderClosed(pair string, price float64, replyMessageId int) {
-	msg := tg.NewMessage(bot.Channel, fmt.Sprintf("%s%s%s",
+func (bot *TgBot) orderClosed(pair string, price, fees float64, replyMessageId int) {
+	msg := tg.NewMessage(bot.Channel, fmt.Sprintf("%s%s%s%s%s",
+		bot.tagFormat(),
 		listFormat("Операция", "#CLOSE"),
 		listFormat("Пара", "#"+pair),
 		listFormat("Цена", f2s(price)),
+		listFormat("Комиссия", f2s(fees)),
+	))
+	msg.ParseMode = tg.ModeHTML
+	msg.ReplyToMessageID = replyMessageId
+
+	bot.send(msg)
+}
+
+func (bot *TgBot) takeProfitExecuted(pair string, price, quantity, fees float64, replyMessageId int) {
+	msg := tg.NewMessage(bot.Channel, fmt.Sprintf("%s%s%s%s%s%s",
+		bot.tagFormat(),
+		listFormat("Операция", "#TP"),
+		listFormat("Пара", "#"+pair),
+		listFormat("Цена", f2s(price)),
+		listFormat("Кол-во", f2s(quantity)),
+		listFormat("Комиссия", f2s(fees)),
+	))
+	msg.ParseMode = tg.ModeHTML
+	msg.ReplyToMessageID = replyMessageId
+
+	bot.send(msg)
+}
+
+func (bot *TgBot) stopLossMoved(pair string, from, to, price float64, replyMessageId int) {
+	msg := tg.NewMessage(bot.Channel, fmt.Sprintf("%s%s%s%s%s",
+		bot.tagFormat(),
+		listFormat("Операция", "#TRAIL"),
+		listFormat("Пара", "#"+pair),
+		listFormat("Цена", f2s(price)),
+		listFormat("Стоп", f2s(from)+" → "+f2s(to)),
+	))
+	msg.ParseMode = tg.ModeHTML
+	msg.ReplyToMessageID = replyMessageId
+
+	bot.send(msg)
+}
+
+func (bot *TgBot) stopLossExecuted(pair string, price, quantity, fees float64, replyMessageId int) {
+	msg := tg.NewMessage(bot.Channel, fmt.Sprintf("%s%s%s%s%s%s",
+		bot.tagFormat(),
+		listFormat("Операция", "#SL"),
+		listFormat("Пара", "#"+pair),
+		listFormat("Цена", f2s(price)),
+		listFormat("Кол-во", f2s(quantity)),
+		listFormat("Комиссия", f2s(fees)),
 	))
 	msg.ParseMode = tg.ModeHTML
 	msg.ReplyToMessageID = replyMessageId
 
-	_, _ = tgBot.Send(msg)
+	bot.send(msg)
+}
+
+func (bot *TgBot) reconciled(pair string, changes []string, replyMessageId int) {
+	text := bot.tagFormat() + listFormat("Операция", "#RECONCILE") + listFormat("Пара", "#"+pair)
+	for _, change := range changes {
+		text += "- " + change + "\n"
+	}
+	msg := tg.NewMessage(bot.Channel, text)
+	msg.ParseMode = tg.ModeHTML
+	msg.ReplyToMessageID = replyMessageId
+
+	bot.send(msg)
+}
+
+// send ignores messages when the bot is not configured (offline runs)
+func (bot *TgBot) send(msg tg.Chattable) tg.Message {
+	if bot.BotAPI == nil {
+		return tg.Message{}
+	}
+	result, _ := bot.Send(msg)
+	return result
+}
+
+func (bot *TgBot) tagFormat() string {
+	if bot.Tag == "" {
+		return ""
+	}
+	return listFormat("Режим", bot.Tag)
 }
 
 func listFormat(key, value string) string {